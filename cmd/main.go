@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/miguelmota/gibot/gibot"
 	log "github.com/sirupsen/logrus"
@@ -22,25 +27,110 @@ func main() {
 	storePath := flag.String("store-path", "", "Store path")
 	file := flag.String("file", "", "Filepath")
 	debug := flag.Bool("debug", false, "Debug")
+	snapshotKeep := flag.Int("snapshot-keep", gibot.DefaultSnapshotMaxCount, "Number of snapshots to keep, -1 keeps all")
+	snapshotMaxAge := flag.Duration("snapshot-max-age", 0, "Delete snapshots older than this, 0 keeps all")
+	from := flag.String("from", "", "Snapshot to diff from")
+	to := flag.String("to", "", "Snapshot to diff to")
+	apply := flag.Bool("apply", false, "Apply the baseline preview")
+	add := flag.String("add", "", "Usernames to add to the baseline")
+	remove := flag.String("remove", "", "Usernames to remove from the baseline")
+	format := flag.String("format", "", "Export format, json or ndjson")
+	since := flag.String("since", "", "Show audit entries since a time, date or duration ago")
+	until := flag.String("until", "", "Show audit entries until a time, date or duration ago")
+	action := flag.String("action", "", "Show audit entries of an action, follow or unfollow")
+	user := flag.String("user", "", "Show audit entries of a user")
+	fix := flag.Bool("fix", false, "Fix the problems found")
+	state := flag.String("state", string(gibot.TargetFollowed), "List the targets in a state, pending, followed or unfollowed")
+	repair := flag.Bool("repair", false, "Repair contradictions and quarantine broken rows")
+	quarantine := flag.Bool("quarantine", false, "Quarantine broken rows")
+	lockWait := flag.Duration("lock-wait", 0, "How long to wait for another run using the store")
+	tokenFile := flag.String("token-file", os.Getenv("GITHUB_TOKEN_FILE"), "File with the access token")
+	tokenCommand := flag.String("token-command", os.Getenv("GITHUB_TOKEN_COMMAND"), "Command that prints the access token")
+	appID := flag.Int64("app-id", 0, "GitHub App ID, for read-only commands")
+	appInstallationID := flag.Int64("app-installation-id", 0, "GitHub App installation ID")
+	appKey := flag.String("app-key", "", "GitHub App private key file")
+	baseURL := flag.String("base-url", os.Getenv("GITHUB_BASE_URL"), "API URL of a GitHub Enterprise Server")
+	uploadURL := flag.String("upload-url", "", "Upload URL of a GitHub Enterprise Server")
+	caBundle := flag.String("ca-bundle", "", "PEM file of additional CA certificates to trust")
+	graphQL := flag.Bool("graphql", false, "Fetch the profiles of search results in batches with the GraphQL API to skip users already followed")
+	noCache := flag.Bool("no-cache", false, "Disable the response cache")
+	cacheDir := flag.String("cache-dir", "", "Response cache directory, by default next to the store")
+	requestTimeout := flag.Duration("request-timeout", gibot.DefaultRequestTimeout, "Timeout of each API call, -1s disables it")
+	maxRetries := flag.Int("max-retries", gibot.DefaultMaxRetries, "Number of retries of failed API calls, -1 disables retries")
+	retryBackoff := flag.Duration("retry-backoff", gibot.DefaultMinBackoff, "Wait before the first retry, doubled on every retry")
+	retryMaxBackoff := flag.Duration("retry-max-backoff", gibot.DefaultMaxBackoff, "Longest wait between retries")
+	record := flag.Bool("record", false, "Record the API calls to the cassette")
+	replay := flag.Bool("replay", false, "Replay the API calls from the cassette on the recorded store, without network access or a token")
+	cassette := flag.String("cassette", "", "Cassette file, by default in the store directory")
 	flag.Parse()
 
 	if *debug {
 		log.SetReportCaller(true)
-	}
-	if accessToken == "" {
-		log.Fatal("GITHUB_ACCESS_TOKEN is required")
+		log.SetLevel(log.DebugLevel)
 	}
 	if *username == "" {
 		log.Fatal("username is required")
 	}
+	if *record && *replay {
+		log.Fatal("-record and -replay cannot be used together")
+	}
 
-	bot := gibot.NewBot(&gibot.Config{
+	config := &gibot.Config{
 		AccessToken: accessToken,
 		Username:    *username,
 		StorePath:   *storePath,
+		// fsck checks the store as it is, before any migration.
+		CheckOnly: cmd == "fsck",
+		SnapshotRetention: gibot.SnapshotRetention{
+			MaxCount: *snapshotKeep,
+			MaxAge:   *snapshotMaxAge,
+		},
+		LockWait:       *lockWait,
+		RequestTimeout: *requestTimeout,
+		CacheDir:       *cacheDir,
+		DisableCache:   *noCache,
+		GraphQL:        *graphQL,
+		BaseURL:        *baseURL,
+		UploadURL:      *uploadURL,
+		CABundle:       *caBundle,
+		Trace:          *debug,
+		CassettePath:   *cassette,
+		Retry: gibot.RetryPolicy{
+			MaxRetries: *maxRetries,
+			MinBackoff: *retryBackoff,
+			MaxBackoff: *retryMaxBackoff,
+		},
+	}
+	switch {
+	case *replay:
+		config.Cassette = gibot.CassetteReplay
+	case *record:
+		config.Cassette = gibot.CassetteRecord
+	}
+	if !*replay && !offlineCommands[cmd] {
+		if err := credentials(config, *tokenFile, *tokenCommand, *appID, *appInstallationID, *appKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	bot, err := gibot.NewBot(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer bot.Close()
+	// log.Fatal skips deferred calls.
+	log.RegisterExitHandler(func() {
+		bot.Close()
 	})
 
-	if cmd == "unfollow" {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	switch cmd {
+	case "unfollow":
+		if bot.ReadOnly() {
+			log.Fatal(gibot.ErrReadOnly)
+		}
 		log.Println("starting unfollowing all targets")
 		file := gibot.NormalizePath(*file)
 
@@ -61,16 +151,45 @@ func main() {
 		}
 
 		for _, target := range targets {
-			if err := bot.Unfollow(target); err != nil {
+			if err := bot.Unfollow(ctx, target); err != nil {
+				if ctx.Err() != nil {
+					break
+				}
 				log.Errorf("unfollow target error: %v", err)
 				continue
 			}
 			log.Printf("unfollowed target %q\n", target)
-			bot.ThrottleWait()
+			if err := bot.ThrottleWait(ctx); err != nil {
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			log.Println("interrupted")
+			return
 		}
 
 		log.Println("done unfollowing all followed targets")
-	} else {
+	case "snapshots":
+		if *from != "" || *to != "" {
+			diffSnapshots(bot, *from, *to)
+		} else {
+			listSnapshots(bot)
+		}
+	case "baseline":
+		baseline(ctx, bot, *apply, splitList(*add), splitList(*remove))
+	case "export":
+		exportState(bot, *file, *format)
+	case "import":
+		importState(bot, *file, *format)
+	case "audit":
+		audit(bot, *since, *until, *action, *user)
+	case "reconcile":
+		reconcile(ctx, bot, *fix)
+	case "fsck":
+		fsck(bot, *repair, *quarantine)
+	case "targets":
+		listTargets(bot, gibot.TargetState(*state))
+	default:
 		searchQueries := strings.Split(*queries, ",")
 
 		log.Printf("config search: %v\n", *search)
@@ -79,7 +198,7 @@ func main() {
 		log.Printf("config unfollow: %v\n", *unfollow)
 		log.Printf("config store path: %s\n", *storePath)
 
-		if err := bot.Start(&gibot.StartConfig{
+		if err := bot.Start(ctx, &gibot.StartConfig{
 			Search:   *search,
 			Queries:  searchQueries,
 			Follow:   *follow,
@@ -89,3 +208,261 @@ func main() {
 		}
 	}
 }
+
+func listSnapshots(bot *gibot.Bot) {
+	snapshots, err := bot.Snapshots()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, snapshot := range snapshots {
+		fmt.Printf("%s\t%v followers\t%v following\n", snapshot.ID, len(snapshot.Followers), len(snapshot.Following))
+	}
+}
+
+func listTargets(bot *gibot.Bot, state gibot.TargetState) {
+	switch state {
+	case gibot.TargetPending, gibot.TargetFollowed, gibot.TargetUnfollowed:
+	default:
+		log.Fatalf("unknown target state %q", state)
+	}
+
+	targets, err := bot.Targets(state)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, target := range targets {
+		fmt.Printf("%s\t%s\t%s\n", target.Username, target.Source, target.Query)
+	}
+}
+
+func diffSnapshots(bot *gibot.Bot, from, to string) {
+	diff, err := bot.DiffSnapshots(from, to)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%s..%s\n", diff.From.ID, diff.To.ID)
+	printUsernames("+ follower", diff.FollowersAdded)
+	printUsernames("- follower", diff.FollowersRemoved)
+	printUsernames("+ following", diff.FollowingAdded)
+	printUsernames("- following", diff.FollowingRemoved)
+}
+
+func printUsernames(prefix string, usernames []string) {
+	for _, username := range usernames {
+		fmt.Printf("%s %s\n", prefix, username)
+	}
+}
+
+func baseline(ctx context.Context, bot *gibot.Bot, apply bool, add, remove []string) {
+	if len(add) > 0 || len(remove) > 0 {
+		if err := bot.AddToBaseline(ctx, add); err != nil {
+			log.Fatal(err)
+		}
+		if err := bot.RemoveFromBaseline(ctx, remove); err != nil {
+			log.Fatal(err)
+		}
+		printUsernames("+", add)
+		printUsernames("-", remove)
+		return
+	}
+
+	var diff *gibot.BaselineDiff
+	var err error
+	if apply {
+		diff, err = bot.Rebaseline(ctx)
+	} else {
+		diff, err = bot.BaselinePreview(ctx)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	printUsernames("+", diff.Added)
+	printUsernames("-", diff.Removed)
+	printUsernames("skipped target", diff.Targets)
+	if !apply {
+		fmt.Println("preview only, run with -apply to save the baseline")
+	}
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func exportState(bot *gibot.Bot, file, format string) {
+	format = stateFormat(file, format)
+
+	if file == "" {
+		if err := bot.Export(os.Stdout, format); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	f, err := os.Create(gibot.NormalizePath(file))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := bot.Export(f, format); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("exported state to %s\n", file)
+}
+
+func importState(bot *gibot.Bot, file, format string) {
+	format = stateFormat(file, format)
+
+	if file == "" {
+		if err := bot.Import(os.Stdin, format); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	f, err := os.Open(gibot.NormalizePath(file))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := bot.Import(f, format); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("imported state from %s\n", file)
+}
+
+// stateFormat returns the format flag, or guesses it from the file extension.
+func stateFormat(file, format string) string {
+	if format != "" {
+		return format
+	}
+	if strings.HasSuffix(file, ".ndjson") || strings.HasSuffix(file, ".jsonl") {
+		return gibot.FormatNDJSON
+	}
+	return gibot.FormatJSON
+}
+
+func audit(bot *gibot.Bot, since, until, action, user string) {
+	filter := &gibot.AuditFilter{
+		Action: action,
+		Target: user,
+	}
+
+	var err error
+	now := time.Now()
+	if filter.Since, err = gibot.ParseAuditTime(since, now); err != nil {
+		log.Fatal(err)
+	}
+	if filter.Until, err = gibot.ParseAuditTime(until, now); err != nil {
+		log.Fatal(err)
+	}
+
+	entries, err := bot.Audit(filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		var rateReset string
+		if entry.RateReset != nil {
+			rateReset = entry.RateReset.Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%v\t%v/%v\t%s\t%s\n",
+			entry.Time.Format(time.RFC3339),
+			entry.RunID,
+			entry.Action,
+			entry.Target,
+			entry.StatusCode,
+			entry.RateRemaining,
+			entry.RateLimit,
+			rateReset,
+			entry.Error,
+		)
+	}
+}
+
+func reconcile(ctx context.Context, bot *gibot.Bot, fix bool) {
+	report, err := bot.Reconcile(ctx, fix)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, mismatch := range report.Mismatches {
+		status := ""
+		if mismatch.Fixed {
+			status = "\tfixed"
+		}
+		fmt.Printf("%s\t%s%s\n", mismatch.Username, mismatch.Kind, status)
+	}
+	fmt.Printf("%v mismatches, %v accounts followed\n", len(report.Mismatches), report.Following)
+}
+
+func fsck(bot *gibot.Bot, repair, quarantine bool) {
+	report, err := bot.Fsck(&gibot.FsckOptions{
+		Repair:     repair,
+		Quarantine: quarantine,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("checked %v rows in %v files, %v problems, %v unresolved\n", report.Rows, report.Files, len(report.Problems), report.Unresolved())
+	if report.Unresolved() > 0 {
+		bot.Close()
+		os.Exit(1)
+	}
+}
+
+// offlineCommands only read or write the store, so they run without
+// credentials.
+var offlineCommands = map[string]bool{
+	"fsck":      true,
+	"export":    true,
+	"import":    true,
+	"snapshots": true,
+	"audit":     true,
+	"targets":   true,
+}
+
+// credentials sets the credentials of the config from the first source
+// given: a token file, a token command, a GitHub App or the
+// GITHUB_ACCESS_TOKEN environment variable.
+func credentials(config *gibot.Config, tokenFile, tokenCommand string, appID, installationID int64, appKey string) error {
+	switch {
+	case tokenFile != "":
+		config.TokenSource = gibot.NewFileTokenSource(tokenFile)
+	case tokenCommand != "":
+		config.TokenSource = gibot.NewCommandTokenSource(tokenCommand)
+	case appID != 0:
+		if installationID == 0 || appKey == "" {
+			return fmt.Errorf("-app-installation-id and -app-key are required with -app-id")
+		}
+		key, err := os.ReadFile(gibot.NormalizePath(appKey))
+		if err != nil {
+			return err
+		}
+		config.App = &gibot.AppCredentials{
+			AppID:          appID,
+			InstallationID: installationID,
+			PrivateKey:     key,
+		}
+	case config.AccessToken == "":
+		return fmt.Errorf("GITHUB_ACCESS_TOKEN, -token-file, -token-command or -app-id is required")
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package gibot
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// Audited actions.
+const (
+	AuditFollow   = "follow"
+	AuditUnfollow = "unfollow"
+)
+
+// AuditEntry records a call to the GitHub API that changed something.
+type AuditEntry struct {
+	Time          time.Time  `json:"time"`
+	RunID         string     `json:"run_id"`
+	Action        string     `json:"action"`
+	Target        string     `json:"target"`
+	StatusCode    int        `json:"status_code,omitempty"`
+	RateLimit     int        `json:"rate_limit,omitempty"`
+	RateRemaining int        `json:"rate_remaining,omitempty"`
+	RateReset     *time.Time `json:"rate_reset,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// AuditFilter selects audit entries. Zero fields match everything.
+type AuditFilter struct {
+	Since  time.Time
+	Until  time.Time
+	Action string
+	Target string
+}
+
+// Match reports whether the entry passes the filter.
+func (f *AuditFilter) Match(entry *AuditEntry) bool {
+	if f == nil {
+		return true
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && entry.Time.After(f.Until) {
+		return false
+	}
+	if f.Action != "" && entry.Action != f.Action {
+		return false
+	}
+	if f.Target != "" && entry.Target != f.Target {
+		return false
+	}
+	return true
+}
+
+// ParseAuditTime parses a time bound of an AuditFilter: an RFC 3339 time, a
+// date in the local time zone, or a duration before now. An empty value is
+// the zero time, which does not bound the entries.
+func ParseAuditTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// Audit returns the audit entries that match the filter, oldest first.
+func (b *Bot) Audit(filter *AuditFilter) ([]*AuditEntry, error) {
+	return b.store.LoadAudit(filter)
+}
+
+// RunID identifies this run of the bot in the audit log.
+func (b *Bot) RunID() string {
+	return b.runID
+}
+
+// audit records the outcome of a mutating API call. resp may be nil when the
+// request failed before a response was received.
+func (b *Bot) audit(action, username string, resp *github.Response, err error) {
+	entry := &AuditEntry{
+		Time:   b.clock.Now(),
+		RunID:  b.runID,
+		Action: action,
+		Target: username,
+	}
+	if resp != nil && resp.Response != nil {
+		entry.StatusCode = resp.StatusCode
+		entry.RateLimit = resp.Rate.Limit
+		entry.RateRemaining = resp.Rate.Remaining
+		if !resp.Rate.Reset.IsZero() {
+			t := resp.Rate.Reset.Time
+			entry.RateReset = &t
+		}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	if err := b.store.AppendAudit(entry); err != nil {
+		log.Errorf("audit log error: %v", err)
+	}
+}
+
+// newRunID returns an ID that sorts by start time.
+func newRunID(start time.Time) string {
+	return start.UTC().Format(snapshotTimeFormat) + "-" + strconv.FormatInt(int64(randomInt(0x1000, 0x10000)), 16)
+}
@@ -0,0 +1,108 @@
+package gibot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseAuditTime(t *testing.T) {
+	now := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"", time.Time{}},
+		{"2020-01-02T03:04:05Z", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"2020-01-02T03:04:05+02:00", time.Date(2020, 1, 2, 1, 4, 5, 0, time.UTC)},
+		{"2020-01-02", time.Date(2020, 1, 2, 0, 0, 0, 0, time.Local)},
+		{"2h", now.Add(-2 * time.Hour)},
+		{"1h30m", now.Add(-90 * time.Minute)},
+	} {
+		got, err := ParseAuditTime(test.value, now)
+		if err != nil {
+			t.Errorf("ParseAuditTime(%q) error: %v", test.value, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("ParseAuditTime(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+
+	for _, value := range []string{"yesterday", "2020-13-01", "3 days"} {
+		if _, err := ParseAuditTime(value, now); err == nil {
+			t.Errorf("ParseAuditTime(%q) did not fail", value)
+		}
+	}
+}
+
+func TestAuditFilterMatch(t *testing.T) {
+	start := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time { return start.Add(time.Duration(hours) * time.Hour) }
+	entries := []*AuditEntry{
+		{Time: at(0), Action: AuditFollow, Target: "alice"},
+		{Time: at(1), Action: AuditFollow, Target: "carol"},
+		{Time: at(2), Action: AuditUnfollow, Target: "alice"},
+		{Time: at(3), Action: AuditUnfollow, Target: "dave"},
+	}
+	relative := func(value string) time.Time {
+		// Durations are before the time of the last entry.
+		bound, err := ParseAuditTime(value, at(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bound
+	}
+
+	for _, test := range []struct {
+		name   string
+		filter *AuditFilter
+		want   []int
+	}{
+		{"nil", nil, []int{0, 1, 2, 3}},
+		{"empty", &AuditFilter{}, []int{0, 1, 2, 3}},
+		{"since", &AuditFilter{Since: at(1)}, []int{1, 2, 3}},
+		{"until", &AuditFilter{Until: at(1)}, []int{0, 1}},
+		{"since and until", &AuditFilter{Since: at(1), Until: at(2)}, []int{1, 2}},
+		{"since duration ago", &AuditFilter{Since: relative("90m")}, []int{2, 3}},
+		{"until duration ago", &AuditFilter{Until: relative("3h")}, []int{0}},
+		{"action", &AuditFilter{Action: AuditUnfollow}, []int{2, 3}},
+		{"user", &AuditFilter{Target: "alice"}, []int{0, 2}},
+		{"action and user", &AuditFilter{Action: AuditFollow, Target: "alice"}, []int{0}},
+		{"all fields", &AuditFilter{Since: at(1), Until: at(3), Action: AuditUnfollow, Target: "dave"}, []int{3}},
+		{"no match", &AuditFilter{Target: "erin"}, nil},
+	} {
+		var got []int
+		for i, entry := range entries {
+			if test.filter.Match(entry) {
+				got = append(got, i)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: matched %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadAuditFilters(t *testing.T) {
+	start := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	for name, store := range map[string]Store{
+		"csv":    NewCSVStore(t.TempDir()),
+		"memory": NewMemoryStore(),
+	} {
+		for i, target := range []string{"alice", "carol", "alice"} {
+			entry := &AuditEntry{Time: start.Add(time.Duration(i) * time.Hour), RunID: "run", Action: AuditFollow, Target: target}
+			if err := store.AppendAudit(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		entries, err := store.LoadAudit(&AuditFilter{Since: start.Add(time.Hour), Target: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || !entries[0].Time.Equal(start.Add(2*time.Hour)) {
+			t.Errorf("%s: entries = %+v, want the last follow of alice", name, entries)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package gibot
+
+import (
+	"context"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BaselineDiff is the change a re-baseline makes to the protected following
+// set.
+type BaselineDiff struct {
+	// Added are followed accounts that become protected.
+	Added []string
+	// Removed are accounts no longer followed that drop out of the baseline.
+	Removed []string
+	// Targets are followed accounts left out because the bot followed them.
+	Targets []string
+	// Following is the new baseline.
+	Following []string
+}
+
+// BaselinePreview compares the protected following set with the accounts
+// followed on GitHub right now. Targets the bot followed itself are not
+// protected.
+func (b *Bot) BaselinePreview(ctx context.Context) (*BaselineDiff, error) {
+	baseline, _, err := b.store.LoadBaseline(BaselineFollowing)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := b.getFollowing(ctx, b.username)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := b.store.LoadTargets()
+	if err != nil {
+		return nil, err
+	}
+	followedTargets := make(map[string]bool)
+	for _, target := range targets {
+		if target.Followed && !target.Deleted {
+			followedTargets[target.Username] = true
+		}
+	}
+
+	protected := make(map[string]bool)
+	for _, username := range baseline {
+		protected[username] = true
+	}
+
+	diff := new(BaselineDiff)
+	for _, username := range usernames(users) {
+		if followedTargets[username] && !protected[username] {
+			diff.Targets = append(diff.Targets, username)
+			continue
+		}
+		diff.Following = append(diff.Following, username)
+	}
+	diff.Added, diff.Removed = diffUsernames(baseline, diff.Following)
+	sort.Strings(diff.Targets)
+	sort.Strings(diff.Following)
+
+	return diff, nil
+}
+
+// Rebaseline replaces the protected following set with the accounts followed
+// on GitHub right now, see BaselinePreview.
+func (b *Bot) Rebaseline(ctx context.Context) (*BaselineDiff, error) {
+	diff, err := b.BaselinePreview(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.store.SaveBaseline(BaselineFollowing, diff.Following); err != nil {
+		return nil, err
+	}
+
+	log.Printf("re-baselined following: %v added, %v removed\n", len(diff.Added), len(diff.Removed))
+	return diff, nil
+}
+
+// AddToBaseline protects the accounts from being unfollowed.
+func (b *Bot) AddToBaseline(ctx context.Context, usernames []string) error {
+	return b.updateBaseline(ctx, func(baseline map[string]bool) {
+		for _, username := range usernames {
+			baseline[username] = true
+		}
+	})
+}
+
+// RemoveFromBaseline stops protecting the accounts from being unfollowed.
+func (b *Bot) RemoveFromBaseline(ctx context.Context, usernames []string) error {
+	return b.updateBaseline(ctx, func(baseline map[string]bool) {
+		for _, username := range usernames {
+			delete(baseline, username)
+		}
+	})
+}
+
+// updateBaseline changes the protected following set. Without one yet, the
+// accounts followed on GitHub right now are captured first, like a run does,
+// so that they stay protected.
+func (b *Bot) updateBaseline(ctx context.Context, update func(baseline map[string]bool)) error {
+	following, found, err := b.store.LoadBaseline(BaselineFollowing)
+	if err != nil {
+		return err
+	}
+	if !found {
+		if following, err = b.currentFollowing(ctx); err != nil {
+			return err
+		}
+		log.Printf("captured baseline of %v followed accounts\n", len(following))
+	}
+
+	baseline := make(map[string]bool)
+	for _, username := range following {
+		baseline[username] = true
+	}
+	update(baseline)
+
+	following = nil
+	for username := range baseline {
+		following = append(following, username)
+	}
+	sort.Strings(following)
+
+	return b.store.SaveBaseline(BaselineFollowing, following)
+}
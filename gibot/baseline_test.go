@@ -0,0 +1,118 @@
+package gibot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestUpdateBaselineCapturesFollowing(t *testing.T) {
+	fake := NewFakeClient("bob")
+	fake.SetFollowing("bob", "carol", "dave")
+	fake.AddUser("erin")
+	store := NewMemoryStore()
+	bot := newTestBot(t, fake, store)
+
+	if err := bot.AddToBaseline(context.Background(), []string{"erin"}); err != nil {
+		t.Fatal(err)
+	}
+	following, found, err := store.LoadBaseline(BaselineFollowing)
+	if err != nil || !found {
+		t.Fatalf("baseline = %v, %v, want it saved", found, err)
+	}
+	if want := []string{"carol", "dave", "erin"}; !reflect.DeepEqual(following, want) {
+		t.Errorf("baseline = %v, want %v", following, want)
+	}
+
+	// An existing baseline is updated without looking at GitHub.
+	if err := bot.RemoveFromBaseline(context.Background(), []string{"dave"}); err != nil {
+		t.Fatal(err)
+	}
+	following, _, _ = store.LoadBaseline(BaselineFollowing)
+	if want := []string{"carol", "erin"}; !reflect.DeepEqual(following, want) {
+		t.Errorf("baseline = %v, want %v", following, want)
+	}
+	if calls := fake.Calls("ListFollowing"); calls != 1 {
+		t.Errorf("%v following lists, want 1", calls)
+	}
+}
+
+// newBaselineBot returns a bot whose baseline protects carol, dave and gina.
+// On GitHub bob follows carol, erin, which is new, alice and gina, which
+// are targets the bot followed, and no longer dave.
+func newBaselineBot(t *testing.T, store *MemoryStore) (*Bot, *FakeClient) {
+	t.Helper()
+	fake := NewFakeClient("bob")
+	fake.SetFollowing("bob", "alice", "carol", "erin", "gina")
+	fake.AddUser("dave")
+	store.SaveBaseline(BaselineFollowing, []string{"carol", "dave", "gina"})
+	store.SaveTargets([]*Target{
+		{Username: "alice", Followed: true},
+		{Username: "gina", Followed: true},
+	})
+	return newTestBot(t, fake, store), fake
+}
+
+func TestBaselinePreview(t *testing.T) {
+	store := NewMemoryStore()
+	bot, _ := newBaselineBot(t, store)
+
+	diff, err := bot.BaselinePreview(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &BaselineDiff{
+		Added:     []string{"erin"},
+		Removed:   []string{"dave"},
+		Targets:   []string{"alice"},
+		Following: []string{"carol", "erin", "gina"},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("diff = %+v, want %+v", diff, want)
+	}
+
+	following, _, _ := store.LoadBaseline(BaselineFollowing)
+	if want := []string{"carol", "dave", "gina"}; !reflect.DeepEqual(following, want) {
+		t.Errorf("preview changed the baseline to %v, want %v", following, want)
+	}
+}
+
+func TestRebaseline(t *testing.T) {
+	store := NewMemoryStore()
+	bot, _ := newBaselineBot(t, store)
+
+	diff, err := bot.Rebaseline(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	following, _, _ := store.LoadBaseline(BaselineFollowing)
+	if !reflect.DeepEqual(following, diff.Following) || !reflect.DeepEqual(following, []string{"carol", "erin", "gina"}) {
+		t.Errorf("baseline = %v, want %v", following, diff.Following)
+	}
+}
+
+func TestAddAndRemoveBaseline(t *testing.T) {
+	store := NewMemoryStore()
+	bot, fake := newBaselineBot(t, store)
+	ctx := context.Background()
+
+	if err := bot.AddToBaseline(ctx, []string{"alice", "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	following, _, _ := store.LoadBaseline(BaselineFollowing)
+	if want := []string{"alice", "carol", "dave", "gina"}; !reflect.DeepEqual(following, want) {
+		t.Errorf("baseline after add = %v, want %v", following, want)
+	}
+
+	if err := bot.RemoveFromBaseline(ctx, []string{"dave", "frank"}); err != nil {
+		t.Fatal(err)
+	}
+	following, _, _ = store.LoadBaseline(BaselineFollowing)
+	if want := []string{"alice", "carol", "gina"}; !reflect.DeepEqual(following, want) {
+		t.Errorf("baseline after remove = %v, want %v", following, want)
+	}
+
+	if calls := fake.Calls("ListFollowing"); calls != 0 {
+		t.Errorf("%v following lists, want none with a baseline", calls)
+	}
+}
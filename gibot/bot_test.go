@@ -0,0 +1,349 @@
+package gibot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// errTest is a permanent error, which is not retried.
+var errTest = errors.New("test error")
+
+// newTestBot returns a bot of bob on the fake and store. Its clock starts
+// now and skips waits instead of sleeping.
+func newTestBot(t *testing.T, client Client, store Store) *Bot {
+	t.Helper()
+	bot, err := NewBot(&Config{
+		Username: "bob",
+		Client:   client,
+		Store:    store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bot.Close() })
+
+	setTestClock(bot, time.Now())
+	return bot
+}
+
+// setTestClock sets the clock of the bot to one that starts at now and skips
+// waits instead of sleeping.
+func setTestClock(bot *Bot, now time.Time) {
+	clk := new(replayClock)
+	clk.advance(now)
+	bot.clock = clk
+	bot.limiter.clock = clk
+	bot.breaker.clock = clk
+}
+
+// eventsOf returns the users of the stored events of a type.
+func eventsOf(t *testing.T, store Store, eventType string) []string {
+	t.Helper()
+	events, err := store.LoadEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []string
+	for _, event := range events {
+		if event.Type == eventType {
+			users = append(users, event.Username)
+		}
+	}
+	return users
+}
+
+func TestFollowTargets(t *testing.T) {
+	fake := NewFakeClient("bob")
+	fake.AddUser("alice", "carol")
+	store := NewMemoryStore()
+	bot := newTestBot(t, fake, store)
+	bot.targets["alice"] = &Target{Username: "alice"}
+	bot.targets["carol"] = &Target{Username: "carol", Followed: true}
+	// dave does not exist anymore.
+	bot.targets["dave"] = &Target{Username: "dave"}
+
+	if err := bot.followTargets(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fake.Following("bob"); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Errorf("bob follows %v, want [alice]", got)
+	}
+	alice := bot.targets["alice"]
+	if !alice.Followed || alice.FollowedDate == nil || alice.Attempts != 1 || alice.LastError != "" {
+		t.Errorf("alice = %+v, want followed on the first attempt", alice)
+	}
+	if carol := bot.targets["carol"]; carol.Attempts != 0 {
+		t.Errorf("carol was followed again, %v attempts", carol.Attempts)
+	}
+	dave := bot.targets["dave"]
+	if dave.Followed || dave.LastError == "" || dave.Attempts != 1 {
+		t.Errorf("dave = %+v, want a failed attempt", dave)
+	}
+	if got := eventsOf(t, store, EventFollowed); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Errorf("followed events = %v, want [alice]", got)
+	}
+
+	stored, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range stored {
+		if target.Username == "alice" && !target.Followed {
+			t.Error("follow of alice not saved")
+		}
+	}
+}
+
+func TestUnfollowTargets(t *testing.T) {
+	fake := NewFakeClient("bob")
+	fake.SetFollowing("bob", "alice", "erin")
+	store := NewMemoryStore()
+	bot := newTestBot(t, fake, store)
+	bot.originalFollowing["erin"] = true
+	bot.targets["alice"] = &Target{Username: "alice", Followed: true}
+	bot.targets["erin"] = &Target{Username: "erin", Followed: true}
+	bot.targets["frank"] = &Target{Username: "frank", Followed: true, Deleted: true}
+
+	if err := bot.unfollowTargets(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fake.Following("bob"); !reflect.DeepEqual(got, []string{"erin"}) {
+		t.Errorf("bob follows %v, want [erin] from the baseline", got)
+	}
+	if alice := bot.targets["alice"]; !alice.Deleted || alice.UnfollowedDate == nil {
+		t.Errorf("alice = %+v, want unfollowed", alice)
+	}
+	if erin := bot.targets["erin"]; erin.Deleted {
+		t.Error("erin from the baseline was unfollowed")
+	}
+	if fake.Calls("Unfollow") != 1 {
+		t.Errorf("%v unfollow calls, want 1", fake.Calls("Unfollow"))
+	}
+	if got := eventsOf(t, store, EventUnfollowed); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Errorf("unfollowed events = %v, want [alice]", got)
+	}
+}
+
+func TestSearchActiveUsers(t *testing.T) {
+	fake := newSearchFake()
+	fake.AddEvents("erin", searchNow)
+	fake.SetSearchResults("language:go", "alice", "carol", "dave", "erin")
+	bot := newTestBot(t, fake, NewMemoryStore())
+	setTestClock(bot, searchNow)
+	bot.snapshot = &Snapshot{Following: []string{"dave"}}
+	bot.originalFollowing["erin"] = true
+
+	if err := bot.searchActiveUsers(context.Background(), []string{"language:go", " "}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bot.targets) != 1 {
+		t.Fatalf("targets = %v, want alice", bot.targets)
+	}
+	alice := bot.targets["alice"]
+	if alice == nil || alice.Source != SourceSearch || alice.Query != "language:go" || alice.RecentEvents != 2 || alice.DiscoveredAt == nil {
+		t.Errorf("alice = %+v, want a search target with 2 recent events", alice)
+	}
+	if calls := fake.Calls("ListEventsPerformedByUser"); calls != 2 {
+		t.Errorf("activity checked %v times, want alice and carol", calls)
+	}
+}
+
+// slowEventsClient tracks the most event lists fetched at once.
+type slowEventsClient struct {
+	*FakeClient
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (c *slowEventsClient) ListEventsPerformedByUser(ctx context.Context, user string, publicOnly bool, opt *github.ListOptions) ([]*github.Event, *github.Response, error) {
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.inFlight--
+		c.mu.Unlock()
+	}()
+
+	time.Sleep(time.Millisecond)
+	return c.FakeClient.ListEventsPerformedByUser(ctx, user, publicOnly, opt)
+}
+
+func TestCheckActiveWorkers(t *testing.T) {
+	fake := NewFakeClient("bob")
+	var users []github.User
+	for i := 0; i < 4*activityWorkers; i++ {
+		login := fmt.Sprintf("user%02d", i)
+		fake.AddUser(login)
+		fake.AddEvents(login, time.Now())
+		users = append(users, github.User{Login: github.String(login)})
+	}
+	client := &slowEventsClient{FakeClient: fake}
+	bot := newTestBot(t, client, NewMemoryStore())
+
+	if err := bot.checkActive(context.Background(), "language:go", users); err != nil {
+		t.Fatal(err)
+	}
+	if client.max > activityWorkers {
+		t.Errorf("%v users checked at once, want at most %v", client.max, activityWorkers)
+	}
+	if calls := fake.Calls("ListEventsPerformedByUser"); calls != len(users) {
+		t.Errorf("activity checked %v times, want %v", calls, len(users))
+	}
+}
+
+// cancelingClient cancels the run after a number of successful calls of a
+// method.
+type cancelingClient struct {
+	*FakeClient
+	method string
+	after  int
+	cancel context.CancelFunc
+	calls  int
+}
+
+func (c *cancelingClient) called(method string) {
+	if method != c.method {
+		return
+	}
+	c.calls++
+	if c.calls == c.after {
+		c.cancel()
+	}
+}
+
+func (c *cancelingClient) Follow(ctx context.Context, user string) (*github.Response, error) {
+	resp, err := c.FakeClient.Follow(ctx, user)
+	if err == nil {
+		c.called("Follow")
+	}
+	return resp, err
+}
+
+func (c *cancelingClient) SearchUsers(ctx context.Context, query string, opt *github.SearchOptions) (*github.UsersSearchResult, *github.Response, error) {
+	c.called("SearchUsers")
+	return c.FakeClient.SearchUsers(ctx, query, opt)
+}
+
+func TestStartCanceledWhileFollowing(t *testing.T) {
+	fake := NewFakeClient("bob")
+	fake.AddUser("alice", "carol")
+	store := NewMemoryStore()
+	store.SaveTargets([]*Target{{Username: "alice"}, {Username: "carol"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newTestBot(t, &cancelingClient{FakeClient: fake, method: "Follow", after: 1, cancel: cancel}, store)
+
+	err := bot.Start(ctx, &StartConfig{Follow: true, Unfollow: true})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Start error = %v, want context.Canceled", err)
+	}
+
+	followed := fake.Following("bob")
+	if len(followed) != 1 {
+		t.Fatalf("bob follows %v, want one target before the cancel", followed)
+	}
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range targets {
+		if want := target.Username == followed[0]; target.Followed != want {
+			t.Errorf("stored %+v, want followed %v", target, want)
+		}
+	}
+	if got := eventsOf(t, store, EventFollowed); !reflect.DeepEqual(got, followed) {
+		t.Errorf("followed events = %v, want %v", got, followed)
+	}
+	if calls := fake.Calls("Unfollow"); calls != 0 {
+		t.Errorf("%v unfollows after the cancel", calls)
+	}
+}
+
+func TestStartCanceledWhileSearching(t *testing.T) {
+	fake := newSearchFake()
+	fake.SetSearchResults("language:rust", "carol")
+	store := NewMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The cancel comes with the search of the second query.
+	bot := newTestBot(t, &cancelingClient{FakeClient: fake, method: "SearchUsers", after: 2, cancel: cancel}, store)
+	setTestClock(bot, searchNow)
+
+	err := bot.Start(ctx, &StartConfig{Search: true, Queries: []string{"language:go", "language:rust"}, Follow: true})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Start error = %v, want context.Canceled", err)
+	}
+
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("stored targets = %+v, want alice and dave of the first query", targets)
+	}
+	for _, target := range targets {
+		if target.Query != "language:go" || target.Followed {
+			t.Errorf("stored %+v, want an unfollowed target of the first query", target)
+		}
+	}
+	if calls := fake.Calls("Follow"); calls != 0 {
+		t.Errorf("%v follows after the cancel", calls)
+	}
+}
+
+func TestCloseKeepsGivenStore(t *testing.T) {
+	store, err := OpenDBStore(filepath.Join(t.TempDir(), "gibot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	bot := newTestBot(t, NewFakeClient("bob"), store)
+	if err := bot.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateTarget(&Target{Username: "alice"}); err != nil {
+		t.Errorf("given store closed by the bot: %v", err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	dir := t.TempDir()
+	bot, err := NewBot(&Config{
+		AccessToken: "ghp_test",
+		Username:    "bob",
+		StorePath:   dir,
+		Cassette:    CassetteRecord,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bot.cassette == nil {
+		t.Fatal("cassette not recorded")
+	}
+	if err := bot.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+	if err := openBot(dir); err != nil {
+		t.Errorf("open after close: %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+package gibot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CacheStats counts the GET requests answered from the response cache.
+type CacheStats struct {
+	// Hits were answered with 304 Not Modified, which GitHub does not count
+	// against the rate limit.
+	Hits int64
+	// Misses were fetched in full.
+	Misses int64
+}
+
+// Bounds of the response cache. Entries not used for cacheMaxAge are
+// removed, then the least recently used ones until the cache fits in
+// cacheMaxBytes.
+const (
+	cacheMaxAge   = 7 * 24 * time.Hour
+	cacheMaxBytes = 64 << 20
+)
+
+// cacheEntry is a cached response, stored as JSON in the cache directory.
+type cacheEntry struct {
+	URL          string      `json:"url"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	StatusCode   int         `json:"status_code"`
+	Header       http.Header `json:"header"`
+	Body         []byte      `json:"body"`
+}
+
+// cacheTransport is an http.RoundTripper that makes GET requests
+// conditional on the cached response's ETag or Last-Modified, and serves a
+// 304 Not Modified answer from the cache.
+type cacheTransport struct {
+	dir       string
+	owner     string
+	transport http.RoundTripper
+	maxAge    time.Duration
+	maxBytes  int64
+	hits      int64
+	misses    int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+// newCacheTransport returns a cacheTransport storing the responses of the
+// owner's requests in dir.
+func newCacheTransport(dir, owner string, transport http.RoundTripper) (*cacheTransport, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	t := &cacheTransport{
+		dir:       dir,
+		owner:     owner,
+		transport: transport,
+		maxAge:    cacheMaxAge,
+		maxBytes:  cacheMaxBytes,
+	}
+	if err := t.evict(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// RoundTrip ...
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.transport.RoundTrip(req)
+	}
+
+	path := filepath.Join(t.dir, cacheKey(t.owner, req)+".json")
+	entry, err := readCacheEntry(path)
+	if err != nil {
+		log.Debugf("cache read error: %v", err)
+	}
+	if entry != nil && entry.URL == req.URL.String() {
+		req = req.Clone(req.Context())
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	} else {
+		entry = nil
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		atomic.AddInt64(&t.hits, 1)
+		// Marks the entry used, see evict.
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return entry.response(req, resp), nil
+	}
+	atomic.AddInt64(&t.misses, 1)
+
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || (etag == "" && lastModified == "") {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	entry = &cacheEntry{
+		URL:          req.URL.String(),
+		ETag:         etag,
+		LastModified: lastModified,
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header,
+		Body:         body,
+	}
+	if err := t.write(path, entry); err != nil {
+		log.Errorf("cache write error: %v", err)
+	}
+	return resp, nil
+}
+
+// write writes a cache entry, evicting others if the cache grows too big.
+func (t *cacheTransport) write(path string, entry *cacheEntry) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := writeCacheEntry(path, entry); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil {
+		t.size += info.Size()
+	}
+	if t.size <= t.maxBytes {
+		return nil
+	}
+	return t.evictLocked()
+}
+
+// evict removes the entries not used for maxAge, then the least recently
+// used ones until the cache fits in maxBytes. An entry's modification time is
+// when it was last used.
+func (t *cacheTransport) evict() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.evictLocked()
+}
+
+func (t *cacheTransport) evictLocked() error {
+	files, err := filepath.Glob(filepath.Join(t.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	var infos []os.FileInfo
+	var size int64
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if t.maxAge > 0 && time.Since(info.ModTime()) > t.maxAge {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		infos = append(infos, info)
+		size += info.Size()
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for len(infos) > 0 && size > t.maxBytes {
+		err := os.Remove(filepath.Join(t.dir, infos[0].Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= infos[0].Size()
+		infos = infos[1:]
+	}
+
+	t.size = size
+	return nil
+}
+
+// stats returns the hits and misses so far.
+func (t *cacheTransport) stats() CacheStats {
+	if t == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&t.hits),
+		Misses: atomic.LoadInt64(&t.misses),
+	}
+}
+
+// response rebuilds the cached response for a 304 answer. The rate limit
+// and token scope headers of the answer replace the cached ones, so they are
+// current.
+func (e *cacheEntry) response(req *http.Request, notModified *http.Response) *http.Response {
+	io.Copy(io.Discard, notModified.Body)
+	notModified.Body.Close()
+
+	header := e.Header.Clone()
+	for name, values := range notModified.Header {
+		name = http.CanonicalHeaderKey(name)
+		if strings.HasPrefix(name, "X-Ratelimit-") || strings.HasSuffix(name, "Oauth-Scopes") {
+			header[name] = values
+		}
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+		StatusCode:    e.StatusCode,
+		Proto:         notModified.Proto,
+		ProtoMajor:    notModified.ProtoMajor,
+		ProtoMinor:    notModified.ProtoMinor,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// cacheKey identifies a request by its owner, URL and Accept header, since
+// GitHub varies responses on them. The owner stands in for the credentials,
+// which change when tokens are refreshed.
+func cacheKey(owner string, req *http.Request) string {
+	h := sha256.New()
+	io.WriteString(h, owner)
+	io.WriteString(h, "\n")
+	io.WriteString(h, req.URL.String())
+	io.WriteString(h, "\n")
+	io.WriteString(h, req.Header.Get("Accept"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readCacheEntry reads a cache entry, or returns nil if there is none.
+func readCacheEntry(path string) (*cacheEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entry := new(cacheEntry)
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func writeCacheEntry(path string, entry *cacheEntry) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(entry)
+	})
+}
@@ -0,0 +1,142 @@
+package gibot
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// etagServer answers GET requests with a body and ETag per path, or 304 Not
+// Modified if the request has the ETag. It counts the conditional requests.
+type etagServer struct {
+	conditional int
+}
+
+func (s *etagServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	etag := `"` + req.URL.Path + `"`
+	header := make(http.Header)
+	header.Set("ETag", etag)
+	if req.Header.Get("If-None-Match") != "" {
+		s.conditional++
+	}
+	if req.Header.Get("If-None-Match") == etag {
+		header.Set("X-RateLimit-Remaining", "4999")
+		return &http.Response{StatusCode: http.StatusNotModified, Header: header, Body: http.NoBody, Request: req}, nil
+	}
+	header.Set("X-RateLimit-Remaining", "5000")
+	body := io.NopCloser(strings.NewReader("body of " + req.URL.Path))
+	return &http.Response{StatusCode: http.StatusOK, Header: header, Body: body, Request: req}, nil
+}
+
+func cacheGet(t *testing.T, transport http.RoundTripper, url string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	server := new(etagServer)
+	cache, err := newCacheTransport(t.TempDir(), "bob", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacheGet(t, cache, "https://api.github.com/users/alice")
+	resp, body := cacheGet(t, cache, "https://api.github.com/users/alice")
+	if server.conditional != 1 {
+		t.Errorf("%v conditional requests, want 1", server.conditional)
+	}
+	if resp.StatusCode != http.StatusOK || body != "body of /users/alice" {
+		t.Errorf("cached response = %v %q, want the first body", resp.StatusCode, body)
+	}
+	if remaining := resp.Header.Get("X-RateLimit-Remaining"); remaining != "4999" {
+		t.Errorf("rate limit remaining = %q, want the one of the 304", remaining)
+	}
+	if stats := cache.stats(); stats != (CacheStats{Hits: 1, Misses: 1}) {
+		t.Errorf("stats = %+v, want 1 hit and 1 miss", stats)
+	}
+}
+
+func TestCacheKeyedByOwner(t *testing.T) {
+	dir := t.TempDir()
+	server := new(etagServer)
+	bob, err := newCacheTransport(dir, "bob", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := newCacheTransport(dir, "alice", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacheGet(t, bob, "https://api.github.com/user/following")
+	cacheGet(t, alice, "https://api.github.com/user/following")
+	if server.conditional != 0 {
+		t.Errorf("alice sent %v conditional requests on the response of bob", server.conditional)
+	}
+	cacheGet(t, bob, "https://api.github.com/user/following")
+	if server.conditional != 1 {
+		t.Errorf("%v conditional requests, want bob's response still cached", server.conditional)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "stale.json")
+	if err := os.WriteFile(stale, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * cacheMaxAge)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	server := new(etagServer)
+	cache, err := newCacheTransport(dir, "bob", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("entry unused for %v not evicted", 2*cacheMaxAge)
+	}
+
+	cacheGet(t, cache, "https://api.github.com/users/alice")
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("cache files = %v, want 1", files)
+	}
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for two entries, alice used before carol.
+	cache.maxBytes = 2*info.Size() + 1
+	cacheGet(t, cache, "https://api.github.com/users/carol")
+	earlier := time.Now().Add(-time.Minute)
+	os.Chtimes(files[0], earlier, earlier)
+	cacheGet(t, cache, "https://api.github.com/users/alice")
+	cacheGet(t, cache, "https://api.github.com/users/dave")
+
+	server.conditional = 0
+	cacheGet(t, cache, "https://api.github.com/users/alice")
+	cacheGet(t, cache, "https://api.github.com/users/carol")
+	if server.conditional != 1 {
+		t.Errorf("%v conditional requests, want alice cached and carol evicted", server.conditional)
+	}
+}
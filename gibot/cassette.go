@@ -0,0 +1,345 @@
+package gibot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CassetteMode is how the bot uses a cassette of recorded API exchanges.
+type CassetteMode string
+
+const (
+	// CassetteRecord writes every API exchange to the cassette.
+	CassetteRecord CassetteMode = "record"
+	// CassetteReplay serves the API calls from the cassette, without network
+	// access or a token, on the recorded clock and store.
+	CassetteReplay CassetteMode = "replay"
+)
+
+// cassetteFile is the name of the cassette in the store directory.
+const cassetteFile = "cassette.ndjson"
+
+// ErrNotRecorded is returned by replayed API calls missing from the cassette.
+var ErrNotRecorded = errors.New("no recorded response")
+
+// interaction is one recorded API exchange, stored as a line of JSON in the
+// cassette. Request headers are not recorded, so the cassette holds no
+// credentials.
+type interaction struct {
+	Time        time.Time   `json:"time"`
+	Method      string      `json:"method"`
+	URI         string      `json:"uri"`
+	RequestBody string      `json:"request_body,omitempty"`
+	StatusCode  int         `json:"status_code,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        string      `json:"body,omitempty"`
+	// Error is the error of a request that got no response.
+	Error string `json:"error,omitempty"`
+}
+
+// cassetteTransport is an http.RoundTripper that records the exchanges of
+// transport to a cassette, or replays them from it.
+type cassetteTransport struct {
+	mode      CassetteMode
+	transport http.RoundTripper
+	mu        sync.Mutex
+	file      *os.File
+	// recorded are the replayed interactions not served yet, by method and
+	// URI, in recorded order.
+	recorded map[string][]*interaction
+	clock    *replayClock
+}
+
+// newCassetteTransport returns a cassetteTransport that records to the
+// cassette at path, truncating it, or replays from it.
+func newCassetteTransport(mode CassetteMode, path string, transport http.RoundTripper) (*cassetteTransport, error) {
+	switch mode {
+	case CassetteRecord:
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		return &cassetteTransport{
+			mode:      mode,
+			transport: transport,
+			file:      f,
+		}, nil
+	case CassetteReplay:
+		interactions, err := readCassette(path)
+		if err != nil {
+			return nil, err
+		}
+		t := &cassetteTransport{
+			mode:     mode,
+			recorded: make(map[string][]*interaction),
+			clock:    new(replayClock),
+		}
+		for _, i := range interactions {
+			key := i.Method + " " + i.URI
+			t.recorded[key] = append(t.recorded[key], i)
+		}
+		if len(interactions) > 0 {
+			t.clock.advance(interactions[0].Time)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unknown cassette mode %q", mode)
+}
+
+// RoundTrip ...
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if t.mode == CassetteReplay {
+		return t.replay(req, string(body))
+	}
+
+	i := &interaction{
+		Time:        time.Now(),
+		Method:      req.Method,
+		URI:         req.URL.RequestURI(),
+		RequestBody: string(body),
+	}
+	if req.Body != nil {
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		i.Error = err.Error()
+		t.record(i)
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	i.StatusCode = resp.StatusCode
+	i.Header = resp.Header
+	i.Body = string(respBody)
+	t.record(i)
+	return resp, nil
+}
+
+// record appends an interaction to the cassette.
+func (t *cassetteTransport) record(i *interaction) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := json.NewEncoder(t.file).Encode(i); err != nil {
+		log.Errorf("cassette write error: %v", err)
+	}
+}
+
+// replay serves the next recorded interaction of the request's method and
+// URI, preferring one with the same request body, and moves the clock to
+// when it was recorded. Request bodies that depend on the time, like
+// GraphQL queries, can differ from the recorded ones.
+func (t *cassetteTransport) replay(req *http.Request, body string) (*http.Response, error) {
+	t.mu.Lock()
+	key := req.Method + " " + req.URL.RequestURI()
+	queue := t.recorded[key]
+	if len(queue) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("%w for %s", ErrNotRecorded, key)
+	}
+	n := 0
+	for j, i := range queue {
+		if i.RequestBody == body {
+			n = j
+			break
+		}
+	}
+	i := queue[n]
+	t.recorded[key] = append(queue[:n:n], queue[n+1:]...)
+	t.mu.Unlock()
+
+	t.clock.advance(i.Time)
+	if i.Error != "" {
+		return nil, errors.New(i.Error)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(i.StatusCode) + " " + http.StatusText(i.StatusCode),
+		StatusCode:    i.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        i.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader([]byte(i.Body))),
+		ContentLength: int64(len(i.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Close closes the cassette being recorded. Closing it again does nothing.
+func (t *cassetteTransport) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// readCassette reads the interactions of a cassette, in recorded order.
+func readCassette(path string) ([]*interaction, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var interactions []*interaction
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		i := new(interaction)
+		err := dec.Decode(i)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid cassette %s: %v", path, err)
+		}
+		interactions = append(interactions, i)
+	}
+	return interactions, nil
+}
+
+// cassetteState is the store at the start of a recording, which replays of
+// the cassette start from.
+type cassetteState struct {
+	State   *State          `json:"state"`
+	Journal []*JournalEntry `json:"journal,omitempty"`
+}
+
+// cassetteStatePath returns the file of the store state recorded with the
+// cassette at path.
+func cassetteStatePath(path string) string {
+	return path + ".state.json"
+}
+
+// saveCassetteState saves the state of store next to the cassette at path.
+func saveCassetteState(path string, store Store) error {
+	state, err := ExportState(store)
+	if err != nil {
+		return err
+	}
+	journal, err := store.LoadJournal()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cassetteStatePath(path), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(&cassetteState{
+			State:   state,
+			Journal: journal,
+		})
+	})
+}
+
+// loadCassetteState returns a MemoryStore with the state saved with the
+// cassette at path.
+func loadCassetteState(path string) (*MemoryStore, error) {
+	data, err := os.ReadFile(cassetteStatePath(path))
+	if err != nil {
+		return nil, fmt.Errorf("no store state recorded with the cassette: %v", err)
+	}
+	var saved cassetteState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid cassette state %s: %v", cassetteStatePath(path), err)
+	}
+	if saved.State == nil {
+		return nil, fmt.Errorf("invalid cassette state %s: no state", cassetteStatePath(path))
+	}
+
+	store := NewMemoryStore()
+	if err := ImportState(store, saved.State); err != nil {
+		return nil, err
+	}
+	for _, entry := range saved.Journal {
+		if err := store.AppendJournal(entry); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// clock tells the time and waits. Live runs use the system clock, replays
+// the recorded one.
+type clock interface {
+	Now() time.Time
+	// Sleep waits for d, or until ctx is done.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	return sleep(ctx, d)
+}
+
+// replayClock is the time of the latest replayed interaction. Sleeping
+// moves it forward instead of waiting, so replays skip rate limit pauses
+// and throttling.
+type replayClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *replayClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *replayClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.advance(c.Now().Add(d))
+	return nil
+}
+
+// advance moves the clock forward to t.
+func (c *replayClock) advance(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+}
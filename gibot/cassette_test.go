@@ -0,0 +1,77 @@
+package gibot
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayLeavesStoreAlone(t *testing.T) {
+	dir := t.TempDir()
+	store := NewCSVStore(dir)
+	if err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveTargets([]*Target{{Username: "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, cassetteFile)
+	if err := saveCassetteState(path, store); err != nil {
+		t.Fatal(err)
+	}
+	// Changed by the recorded run.
+	if err := store.SaveTargets([]*Target{{Username: "alice", Followed: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	data, err := json.Marshal(&interaction{Time: recorded, Method: "GET", URI: "/user", StatusCode: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bot, err := NewBot(&Config{Username: "bob", StorePath: dir, Cassette: CassetteReplay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bot.Close()
+
+	targets, err := bot.store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Followed {
+		t.Fatalf("replayed targets = %+v, want alice as recorded", targets)
+	}
+
+	bot.audit(AuditFollow, "alice", nil, nil)
+	if err := bot.appendJournal(JournalFollow, JournalIntent, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := bot.store.LoadJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := bot.store.LoadAudit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal) != 1 || !journal[0].Time.Equal(recorded) {
+		t.Errorf("replayed journal = %+v, want one entry at %v", journal, recorded)
+	}
+	if len(audit) != 1 || !audit[0].Time.Equal(recorded) {
+		t.Errorf("replayed audit = %+v, want one entry at %v", audit, recorded)
+	}
+
+	if journal, _ := store.LoadJournal(); len(journal) != 0 {
+		t.Errorf("replay wrote the journal of the store: %+v", journal)
+	}
+	if audit, _ := store.LoadAudit(nil); len(audit) != 0 {
+		t.Errorf("replay wrote the audit log of the store: %+v", audit)
+	}
+}
@@ -0,0 +1,178 @@
+package gibot
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// Client is the part of the GitHub API used by the bot.
+type Client interface {
+	ListFollowers(ctx context.Context, user string, opt *github.ListOptions) ([]*github.User, *github.Response, error)
+	ListFollowing(ctx context.Context, user string, opt *github.ListOptions) ([]*github.User, *github.Response, error)
+	IsFollowing(ctx context.Context, user, target string) (bool, *github.Response, error)
+	Follow(ctx context.Context, user string) (*github.Response, error)
+	Unfollow(ctx context.Context, user string) (*github.Response, error)
+	ListEventsPerformedByUser(ctx context.Context, user string, publicOnly bool, opt *github.ListOptions) ([]*github.Event, *github.Response, error)
+	SearchUsers(ctx context.Context, query string, opt *github.SearchOptions) (*github.UsersSearchResult, *github.Response, error)
+	AuthenticatedUser(ctx context.Context) (*github.User, *github.Response, error)
+	RateLimits(ctx context.Context) (*github.RateLimits, *github.Response, error)
+}
+
+// transports are the HTTP layers of a GitHub client that the bot reports
+// on.
+type transports struct {
+	cache    *cacheTransport
+	metrics  *metricsTransport
+	cassette *cassetteTransport
+}
+
+// cassettePath returns the cassette file of the config. path is the store
+// path.
+func cassettePath(config *Config, path string) string {
+	if config.CassettePath != "" {
+		return NormalizePath(config.CassettePath)
+	}
+	return filepath.Join(storeDir(path), cassetteFile)
+}
+
+// newGitHubClient returns the GitHub client of the config, and its
+// transports. Requests go through the token, the response cache, the
+// metrics and the cassette, in that order. path is the store path.
+func newGitHubClient(config *Config, path string) (Client, *transports, error) {
+	network, err := newTransport(config.CABundle)
+	if err != nil {
+		return nil, nil, err
+	}
+	layers := new(transports)
+	transport := http.RoundTripper(network)
+	if config.Cassette != "" {
+		layers.cassette, err = newCassetteTransport(config.Cassette, cassettePath(config, path), network)
+		if err != nil {
+			return nil, nil, err
+		}
+		transport = layers.cassette
+	}
+	layers.metrics = newMetricsTransport(transport, config.Trace)
+	transport = layers.metrics
+
+	baseURL, uploadURL := "", ""
+	if config.BaseURL != "" {
+		baseURL, uploadURL, err = enterpriseURLs(config.BaseURL, config.UploadURL)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	ts := config.TokenSource
+	switch {
+	case config.Cassette == CassetteReplay:
+		// Replays need no token.
+		ts = oauth2.StaticTokenSource(&oauth2.Token{})
+	case config.App != nil:
+		apiURL := baseURL
+		if apiURL == "" {
+			apiURL = defaultBaseURL
+		}
+		tokenTransport := transport
+		if config.Cassette == CassetteRecord {
+			// Keep installation tokens out of the cassette.
+			tokenTransport = network
+		}
+		ts, err = newAppTokenSource(config.App, apiURL, tokenTransport)
+		if err != nil {
+			return nil, nil, err
+		}
+	case ts == nil:
+		ts = oauth2.StaticTokenSource(
+			&oauth2.Token{
+				AccessToken: config.AccessToken,
+			},
+		)
+	}
+
+	cacheDir := NormalizePath(config.CacheDir)
+	if cacheDir == "" && config.Store == nil {
+		cacheDir = filepath.Join(storeDir(path), "cache")
+	}
+	// Cached responses would make recordings depend on the cache.
+	if cacheDir != "" && !config.DisableCache && config.Cassette == "" {
+		layers.cache, err = newCacheTransport(cacheDir, config.Username, transport)
+		if err != nil {
+			return nil, nil, err
+		}
+		transport = layers.cache
+	}
+
+	tc := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: ts,
+			Base:   transport,
+		},
+	}
+	client := github.NewClient(tc)
+	if baseURL != "" {
+		client, err = github.NewEnterpriseClient(baseURL, uploadURL, tc)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return NewClient(client), layers, nil
+}
+
+// defaultBaseURL is the REST API URL of GitHub.com.
+const defaultBaseURL = "https://api.github.com/"
+
+// githubClient is the Client backed by the GitHub REST API. It is also a
+// ProfileClient using the GraphQL API.
+type githubClient struct {
+	client     *github.Client
+	graphQLURL string
+}
+
+// NewClient returns a Client that calls the GitHub API through client.
+func NewClient(client *github.Client) Client {
+	return &githubClient{
+		client:     client,
+		graphQLURL: graphQLURL(client.BaseURL),
+	}
+}
+
+func (c *githubClient) ListFollowers(ctx context.Context, user string, opt *github.ListOptions) ([]*github.User, *github.Response, error) {
+	return c.client.Users.ListFollowers(ctx, user, opt)
+}
+
+func (c *githubClient) ListFollowing(ctx context.Context, user string, opt *github.ListOptions) ([]*github.User, *github.Response, error) {
+	return c.client.Users.ListFollowing(ctx, user, opt)
+}
+
+func (c *githubClient) IsFollowing(ctx context.Context, user, target string) (bool, *github.Response, error) {
+	return c.client.Users.IsFollowing(ctx, user, target)
+}
+
+func (c *githubClient) Follow(ctx context.Context, user string) (*github.Response, error) {
+	return c.client.Users.Follow(ctx, user)
+}
+
+func (c *githubClient) Unfollow(ctx context.Context, user string) (*github.Response, error) {
+	return c.client.Users.Unfollow(ctx, user)
+}
+
+func (c *githubClient) ListEventsPerformedByUser(ctx context.Context, user string, publicOnly bool, opt *github.ListOptions) ([]*github.Event, *github.Response, error) {
+	return c.client.Activity.ListEventsPerformedByUser(ctx, user, publicOnly, opt)
+}
+
+func (c *githubClient) SearchUsers(ctx context.Context, query string, opt *github.SearchOptions) (*github.UsersSearchResult, *github.Response, error) {
+	return c.client.Search.Users(ctx, query, opt)
+}
+
+func (c *githubClient) AuthenticatedUser(ctx context.Context) (*github.User, *github.Response, error) {
+	return c.client.Users.Get(ctx, "")
+}
+
+func (c *githubClient) RateLimits(ctx context.Context) (*github.RateLimits, *github.Response, error) {
+	return c.client.RateLimits(ctx)
+}
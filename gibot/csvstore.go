@@ -0,0 +1,678 @@
+package gibot
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CSVStore is the default Store. It keeps the state as CSV files in a
+// directory.
+type CSVStore struct {
+	dir                   string
+	schemaFile            string
+	targetFile            string
+	originalFollowersFile string
+	originalFollowingFile string
+	eventsFile            string
+	journalFile           string
+	snapshotsDir          string
+	auditFile             string
+}
+
+// NewCSVStore ...
+func NewCSVStore(dir string) *CSVStore {
+	return &CSVStore{
+		dir:                   dir,
+		schemaFile:            filepath.Join(dir, "schema_version"),
+		targetFile:            filepath.Join(dir, "targets.csv"),
+		originalFollowersFile: filepath.Join(dir, "original_followers.csv"),
+		originalFollowingFile: filepath.Join(dir, "original_following.csv"),
+		eventsFile:            filepath.Join(dir, "events.csv"),
+		journalFile:           filepath.Join(dir, "journal.csv"),
+		snapshotsDir:          filepath.Join(dir, "snapshots"),
+		auditFile:             filepath.Join(dir, "audit.csv"),
+	}
+}
+
+// LoadTargets ...
+func (s *CSVStore) LoadTargets() ([]*Target, error) {
+	var targets []*Target
+	err := readCSVRows(s.targetFile, []string{"username"}, func(header csvHeader, row []string) error {
+		target, err := parseTargetRecord(header, row)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, target)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return targets, nil
+}
+
+// SaveTargets ...
+func (s *CSVStore) SaveTargets(targets []*Target) error {
+	records := [][]string{
+		targetColumns,
+	}
+	for _, target := range targets {
+		records = append(records, targetRecord(target))
+	}
+
+	return writeCSV(s.targetFile, records)
+}
+
+// LoadBaseline ...
+func (s *CSVStore) LoadBaseline(kind BaselineKind) ([]string, bool, error) {
+	file, err := s.baselineFile(kind)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, false, nil
+	}
+
+	var usernames []string
+	err = readCSVRows(file, baselineColumns, func(header csvHeader, row []string) error {
+		username, err := parseBaselineRecord(header, row)
+		if err != nil {
+			return err
+		}
+		usernames = append(usernames, username)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return usernames, true, nil
+}
+
+// SaveBaseline ...
+func (s *CSVStore) SaveBaseline(kind BaselineKind, usernames []string) error {
+	file, err := s.baselineFile(kind)
+	if err != nil {
+		return err
+	}
+
+	records := [][]string{
+		baselineColumns,
+	}
+	for _, username := range usernames {
+		records = append(records, []string{
+			username,
+		})
+	}
+
+	return writeCSV(file, records)
+}
+
+// RecordEvent appends the event to the events file.
+func (s *CSVStore) RecordEvent(event *Event) error {
+	return appendCSV(s.eventsFile, eventColumns, eventRecord(event))
+}
+
+// LoadEvents ...
+func (s *CSVStore) LoadEvents() ([]*Event, error) {
+	var events []*Event
+	err := readCSVRows(s.eventsFile, eventColumns[:3], func(header csvHeader, row []string) error {
+		event, err := parseEventRecord(header, row)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// AppendJournal appends the entry to the journal file and syncs it.
+func (s *CSVStore) AppendJournal(entry *JournalEntry) error {
+	return appendCSV(s.journalFile, journalColumns, journalRecord(entry))
+}
+
+// LoadJournal ...
+func (s *CSVStore) LoadJournal() ([]*JournalEntry, error) {
+	var entries []*JournalEntry
+	err := readCSVRows(s.journalFile, journalColumns, func(header csvHeader, row []string) error {
+		entry, err := parseJournalRecord(header, row)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	var lastErr *lastRowError
+	if errors.As(err, &lastErr) {
+		// The last entry may be torn by a crash mid-write.
+		log.Warnf("ignoring torn last journal entry: %v", err)
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v, run fsck", err)
+	}
+
+	return entries, nil
+}
+
+// ClearJournal ...
+func (s *CSVStore) ClearJournal() error {
+	err := os.Remove(s.journalFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SaveSnapshot writes the snapshot to its own file in the snapshots
+// directory.
+func (s *CSVStore) SaveSnapshot(snapshot *Snapshot) error {
+	if err := os.MkdirAll(s.snapshotsDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	records := [][]string{
+		snapshotColumns,
+	}
+	for _, username := range snapshot.Followers {
+		records = append(records, []string{string(BaselineFollowers), username})
+	}
+	for _, username := range snapshot.Following {
+		records = append(records, []string{string(BaselineFollowing), username})
+	}
+
+	return writeCSV(s.snapshotFile(snapshot.ID), records)
+}
+
+// ListSnapshots ...
+func (s *CSVStore) ListSnapshots() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.snapshotsDir, "*.csv"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, file := range files {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(file), ".csv"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// LoadSnapshot ...
+func (s *CSVStore) LoadSnapshot(id string) (*Snapshot, error) {
+	t, err := time.Parse(snapshotTimeFormat, id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot id %q", id)
+	}
+
+	file := s.snapshotFile(id)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, fmt.Errorf("snapshot %q not found", id)
+	}
+
+	snapshot := &Snapshot{
+		ID:   id,
+		Time: t,
+	}
+	err = readCSVRows(file, snapshotColumns, func(header csvHeader, row []string) error {
+		kind, username, err := parseSnapshotRecord(header, row)
+		if err != nil {
+			return err
+		}
+		if kind == BaselineFollowers {
+			snapshot.Followers = append(snapshot.Followers, username)
+		} else {
+			snapshot.Following = append(snapshot.Following, username)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// DeleteSnapshot ...
+func (s *CSVStore) DeleteSnapshot(id string) error {
+	err := os.Remove(s.snapshotFile(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *CSVStore) snapshotFile(id string) string {
+	return filepath.Join(s.snapshotsDir, id+".csv")
+}
+
+// baselineColumns are the columns of the baseline files.
+var baselineColumns = []string{"username"}
+
+// eventColumns are the columns of events.csv.
+var eventColumns = []string{"time", "type", "username", "message"}
+
+// journalColumns are the columns of journal.csv.
+var journalColumns = []string{"time", "action", "phase", "username"}
+
+// snapshotColumns are the columns of the snapshot files.
+var snapshotColumns = []string{"list", "username"}
+
+func parseBaselineRecord(header csvHeader, line []string) (string, error) {
+	username := header.get(line, "username")
+	if username == "" {
+		return "", errors.New("missing username")
+	}
+	return username, nil
+}
+
+func eventRecord(event *Event) []string {
+	return []string{
+		fmt.Sprintf("%v", event.Time.Unix()),
+		event.Type,
+		event.Username,
+		event.Message,
+	}
+}
+
+func parseEventRecord(header csvHeader, line []string) (*Event, error) {
+	t, err := parseCSVTime(header.get(line, "time"))
+	if err != nil || t == nil {
+		return nil, fmt.Errorf("time: invalid value %q", header.get(line, "time"))
+	}
+	return &Event{
+		Time:     *t,
+		Type:     header.get(line, "type"),
+		Username: header.get(line, "username"),
+		Message:  header.get(line, "message"),
+	}, nil
+}
+
+func journalRecord(entry *JournalEntry) []string {
+	return []string{
+		fmt.Sprintf("%v", entry.Time.Unix()),
+		entry.Action,
+		entry.Phase,
+		entry.Username,
+	}
+}
+
+func parseJournalRecord(header csvHeader, line []string) (*JournalEntry, error) {
+	t, err := parseCSVTime(header.get(line, "time"))
+	if err != nil || t == nil {
+		return nil, fmt.Errorf("time: invalid value %q", header.get(line, "time"))
+	}
+	entry := &JournalEntry{
+		Time:     *t,
+		Action:   header.get(line, "action"),
+		Phase:    header.get(line, "phase"),
+		Username: header.get(line, "username"),
+	}
+	switch {
+	case entry.Action != JournalFollow && entry.Action != JournalUnfollow:
+		return nil, fmt.Errorf("action: invalid value %q", entry.Action)
+	case entry.Phase != JournalIntent && entry.Phase != JournalDone && entry.Phase != JournalFailed:
+		return nil, fmt.Errorf("phase: invalid value %q", entry.Phase)
+	case entry.Username == "":
+		return nil, errors.New("missing username")
+	}
+	return entry, nil
+}
+
+func parseSnapshotRecord(header csvHeader, line []string) (BaselineKind, string, error) {
+	kind := BaselineKind(header.get(line, "list"))
+	if kind != BaselineFollowers && kind != BaselineFollowing {
+		return "", "", fmt.Errorf("list: invalid value %q", kind)
+	}
+	username := header.get(line, "username")
+	if username == "" {
+		return "", "", errors.New("missing username")
+	}
+	return kind, username, nil
+}
+
+// auditColumns are the columns of audit.csv.
+var auditColumns = []string{
+	"time",
+	"run_id",
+	"action",
+	"target",
+	"status_code",
+	"rate_limit",
+	"rate_remaining",
+	"rate_reset",
+	"error",
+}
+
+// AppendAudit appends the entry to the audit file and syncs it.
+func (s *CSVStore) AppendAudit(entry *AuditEntry) error {
+	return appendCSV(s.auditFile, auditColumns, auditRecord(entry))
+}
+
+// LoadAudit ...
+func (s *CSVStore) LoadAudit(filter *AuditFilter) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+	err := readCSVRows(s.auditFile, auditColumns[:4], func(header csvHeader, row []string) error {
+		entry, err := parseAuditRecord(header, row)
+		if err != nil {
+			return err
+		}
+		if filter.Match(entry) {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	var lastErr *lastRowError
+	if errors.As(err, &lastErr) {
+		// The last entry may be torn by a crash mid-write.
+		log.Warnf("ignoring torn last audit entry: %v", err)
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func auditRecord(entry *AuditEntry) []string {
+	return []string{
+		fmt.Sprintf("%v", entry.Time.Unix()),
+		entry.RunID,
+		entry.Action,
+		entry.Target,
+		fmt.Sprintf("%v", entry.StatusCode),
+		fmt.Sprintf("%v", entry.RateLimit),
+		fmt.Sprintf("%v", entry.RateRemaining),
+		formatCSVTime(entry.RateReset),
+		entry.Error,
+	}
+}
+
+func parseAuditRecord(header csvHeader, line []string) (*AuditEntry, error) {
+	t, err := parseCSVTime(header.get(line, "time"))
+	if err != nil || t == nil {
+		return nil, fmt.Errorf("time: invalid value %q", header.get(line, "time"))
+	}
+	entry := &AuditEntry{
+		Time:   *t,
+		RunID:  header.get(line, "run_id"),
+		Action: header.get(line, "action"),
+		Target: header.get(line, "target"),
+		Error:  header.get(line, "error"),
+	}
+
+	ints := map[string]*int{
+		"status_code":    &entry.StatusCode,
+		"rate_limit":     &entry.RateLimit,
+		"rate_remaining": &entry.RateRemaining,
+	}
+	for column, value := range ints {
+		i, err := parseCSVInt(header.get(line, column))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", column, err)
+		}
+		*value = int(i)
+	}
+
+	if entry.RateReset, err = parseCSVTime(header.get(line, "rate_reset")); err != nil {
+		return nil, fmt.Errorf("rate_reset: %v", err)
+	}
+
+	return entry, nil
+}
+
+// targetColumns are the columns of targets.csv.
+var targetColumns = []string{
+	"username",
+	"last_activity",
+	"followed",
+	"followed_date",
+	"deleted",
+	"user_id",
+	"source",
+	"query",
+	"discovered_at",
+	"recent_events",
+	"score",
+	"followed_back_date",
+	"unfollowed_date",
+	"attempts",
+	"last_error",
+}
+
+func targetRecord(target *Target) []string {
+	return []string{
+		target.Username,
+		formatCSVTime(target.LastActivity),
+		fmt.Sprintf("%v", target.Followed),
+		formatCSVTime(target.FollowedDate),
+		fmt.Sprintf("%v", target.Deleted),
+		fmt.Sprintf("%v", target.UserID),
+		target.Source,
+		target.Query,
+		formatCSVTime(target.DiscoveredAt),
+		fmt.Sprintf("%v", target.RecentEvents),
+		strconv.FormatFloat(target.Score, 'f', -1, 64),
+		formatCSVTime(target.FollowedBackDate),
+		formatCSVTime(target.UnfollowedDate),
+		fmt.Sprintf("%v", target.Attempts),
+		target.LastError,
+	}
+}
+
+func parseTargetRecord(header csvHeader, line []string) (*Target, error) {
+	var err error
+	target := &Target{
+		Username:  header.get(line, "username"),
+		Source:    header.get(line, "source"),
+		Query:     header.get(line, "query"),
+		LastError: header.get(line, "last_error"),
+	}
+	if target.Username == "" {
+		return nil, errors.New("missing username")
+	}
+
+	bools := map[string]*bool{
+		"followed": &target.Followed,
+		"deleted":  &target.Deleted,
+	}
+	for column, value := range bools {
+		if *value, err = parseCSVBool(header.get(line, column)); err != nil {
+			return nil, fmt.Errorf("%s: %v", column, err)
+		}
+	}
+
+	times := map[string]**time.Time{
+		"last_activity":      &target.LastActivity,
+		"followed_date":      &target.FollowedDate,
+		"discovered_at":      &target.DiscoveredAt,
+		"followed_back_date": &target.FollowedBackDate,
+		"unfollowed_date":    &target.UnfollowedDate,
+	}
+	for column, value := range times {
+		if *value, err = parseCSVTime(header.get(line, column)); err != nil {
+			return nil, fmt.Errorf("%s: %v", column, err)
+		}
+	}
+
+	if target.UserID, err = parseCSVInt(header.get(line, "user_id")); err != nil {
+		return nil, fmt.Errorf("user_id: %v", err)
+	}
+	recentEvents, err := parseCSVInt(header.get(line, "recent_events"))
+	if err != nil {
+		return nil, fmt.Errorf("recent_events: %v", err)
+	}
+	target.RecentEvents = int(recentEvents)
+	attempts, err := parseCSVInt(header.get(line, "attempts"))
+	if err != nil {
+		return nil, fmt.Errorf("attempts: %v", err)
+	}
+	target.Attempts = int(attempts)
+	if score := header.get(line, "score"); score != "" {
+		if target.Score, err = strconv.ParseFloat(score, 64); err != nil {
+			return nil, fmt.Errorf("score: %v", err)
+		}
+	}
+
+	return target, nil
+}
+
+func (s *CSVStore) baselineFile(kind BaselineKind) (string, error) {
+	switch kind {
+	case BaselineFollowers:
+		return s.originalFollowersFile, nil
+	case BaselineFollowing:
+		return s.originalFollowingFile, nil
+	default:
+		return "", fmt.Errorf("unknown baseline %q", kind)
+	}
+}
+
+func readCSV(file string) ([][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	return r.ReadAll()
+}
+
+// lastRowError is returned by readCSVRows when the last row of the file is
+// bad, which is how a row torn by a crash mid-append looks.
+type lastRowError struct {
+	err error
+}
+
+func (e *lastRowError) Error() string {
+	return e.err.Error()
+}
+
+func (e *lastRowError) Unwrap() error {
+	return e.err
+}
+
+// readCSVRows calls fn for every row of a CSV file after its header. Errors
+// are reported with the file and line number, as a *lastRowError if the row
+// is the last one. A missing file has no rows.
+func readCSVRows(file string, required []string, fn func(header csvHeader, row []string) error) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+
+	line, err := r.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	header := newCSVHeader(line)
+	for _, column := range required {
+		if !header.has(column) {
+			return fmt.Errorf("%s:1: missing %s column", file, column)
+		}
+	}
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return rowError(r, fmt.Errorf("%s: %v", file, err))
+		}
+		if err := fn(header, row); err != nil {
+			n, _ := r.FieldPos(0)
+			return rowError(r, fmt.Errorf("%s:%v: %v", file, n, err))
+		}
+	}
+}
+
+// rowError returns err, as a *lastRowError if r has no rows left.
+func rowError(r *csv.Reader, err error) error {
+	if _, next := r.Read(); next == io.EOF {
+		return &lastRowError{err: err}
+	}
+	return err
+}
+
+func writeCSV(file string, records [][]string) error {
+	return writeFileAtomic(file, func(fo io.Writer) error {
+		w := csv.NewWriter(fo)
+		for _, record := range records {
+			if err := w.Write(record); err != nil {
+				return fmt.Errorf("error writing record to csv: %v", err)
+			}
+		}
+
+		w.Flush()
+		return w.Error()
+	})
+}
+
+// appendCSV appends a record to a file, writing the header first if the file
+// is new, and syncs it. A last row torn by a crash mid-append is ended first,
+// so the record does not run into it.
+func appendCSV(file string, header, record []string) error {
+	fo, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer fo.Close()
+
+	info, err := fo.Stat()
+	if err != nil {
+		return err
+	}
+	var records [][]string
+	if info.Size() == 0 {
+		records = append(records, header)
+	} else {
+		last := make([]byte, 1)
+		if _, err := fo.ReadAt(last, info.Size()-1); err != nil {
+			return err
+		}
+		if last[0] != '\n' {
+			if _, err := fo.Write([]byte("\n")); err != nil {
+				return err
+			}
+		}
+	}
+	records = append(records, record)
+
+	w := csv.NewWriter(fo)
+	if err := w.WriteAll(records); err != nil {
+		return err
+	}
+
+	return fo.Sync()
+}
@@ -0,0 +1,164 @@
+package gibot
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSVStoreLoadJournal(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		rows    []string
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "complete",
+			rows: []string{"1,follow,intent,a", "2,follow,done,a", "3,follow,intent,b", "4,follow,done,b"},
+			want: 4,
+		},
+		{
+			name: "torn last row",
+			rows: []string{"1,follow,intent,a", "2,follow,done,a", "3,follow,intent,b", "4,foll"},
+			want: 3,
+		},
+		{
+			name:    "bad row in the middle",
+			rows:    []string{"1,follow,intent,a", "2,follow,bogus,a", "3,follow,intent,b", "4,follow,done,b"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			data := strings.Join(journalColumns, ",") + "\n" + strings.Join(tc.rows, "\n")
+			if err := os.WriteFile(filepath.Join(dir, "journal.csv"), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := NewCSVStore(dir).LoadJournal()
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "fsck") {
+					t.Fatalf("error = %v, want an error pointing to fsck", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tc.want {
+				t.Errorf("loaded %v entries, want %v", len(entries), tc.want)
+			}
+		})
+	}
+}
+
+func TestCSVStoreLoadAuditTornLastRow(t *testing.T) {
+	dir := t.TempDir()
+	rows := []string{
+		strings.Join(auditColumns, ","),
+		"1577836800,run,follow,alice,204,5000,4999,1577840400,",
+		"1577836801,run,unfollow,carol,204,5000,4998,1577840400,",
+		`1577836802,run,follow,dave,0,0,0,0,"Put ""https://api.gith`,
+	}
+	if err := os.WriteFile(filepath.Join(dir, "audit.csv"), []byte(strings.Join(rows, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := NewCSVStore(dir).LoadAudit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Target != "carol" {
+		t.Errorf("loaded %+v, want the entries of alice and carol", entries)
+	}
+}
+
+func TestCSVStoreTargetsRoundTrip(t *testing.T) {
+	// CSV times are unix seconds.
+	at := func(sec int64) *time.Time {
+		t := time.Unix(sec, 0)
+		return &t
+	}
+	want := []*Target{
+		{
+			Username:         "alice",
+			UserID:           42,
+			Source:           SourceSearch,
+			Query:            `language:go location:"San Francisco, CA"`,
+			DiscoveredAt:     at(1577836800),
+			LastActivity:     at(1577833200),
+			RecentEvents:     2,
+			Score:            1.8125,
+			Followed:         true,
+			FollowedDate:     at(1577840400),
+			FollowedBackDate: at(1577923200),
+			Deleted:          true,
+			UnfollowedDate:   at(1578441600),
+			Attempts:         3,
+			LastError:        "PUT https://api.github.com/user/following/alice: 502 Bad Gateway",
+		},
+		{Username: "bob"},
+	}
+
+	store := NewCSVStore(t.TempDir())
+	if err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveTargets(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("loaded %v targets, want %v", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("target %v = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWriteFileAtomicMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no permission bits on Windows")
+	}
+	dir := t.TempDir()
+	write := func(w io.Writer) error {
+		_, err := io.WriteString(w, "username\n")
+		return err
+	}
+
+	created := filepath.Join(dir, "targets.csv")
+	if err := writeFileAtomic(created, write); err != nil {
+		t.Fatal(err)
+	}
+	kept := filepath.Join(dir, "followers.csv")
+	if err := os.WriteFile(kept, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(kept, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(kept, write); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]os.FileMode{created: 0644, kept: 0640} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("mode of %s = %v, want %v", filepath.Base(path), info.Mode().Perm(), want)
+		}
+	}
+}
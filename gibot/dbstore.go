@@ -0,0 +1,820 @@
+package gibot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Buckets of the database store.
+const (
+	bucketTargets    = "targets"
+	bucketBaselines  = "baselines"
+	bucketEvents     = "events"
+	bucketJournal    = "journal"
+	bucketMeta       = "meta"
+	bucketSnapshots  = "snapshots"
+	bucketAudit      = "audit"
+	bucketQuarantine = "quarantine"
+)
+
+// DBSchemaVersion is the version of the database records written by this
+// package.
+const DBSchemaVersion = 1
+
+// Every transaction in the database file is a frame: a magic number, the
+// payload length, a checksum of those two, a checksum of the payload and the
+// payload. The header checksum tells a damaged length from a transaction cut
+// short at the end of the file.
+const (
+	dbFrameMagic      = 0x67626462
+	dbFrameHeaderSize = 16
+)
+
+// errTornFrame is returned for the last transaction of the file when it was
+// not completely written.
+var errTornFrame = errors.New("incomplete transaction")
+
+// dbCompactMinSize is the file size under which the database is never
+// compacted.
+const dbCompactMinSize = 1 << 20
+
+// ErrStoreClosed is returned when using a closed store.
+var ErrStoreClosed = errors.New("store is closed")
+
+// TargetState is the lifecycle state of a target.
+type TargetState string
+
+const (
+	// TargetPending targets have not been followed yet.
+	TargetPending TargetState = "pending"
+	// TargetFollowed targets are currently followed.
+	TargetFollowed TargetState = "followed"
+	// TargetUnfollowed targets were followed and later unfollowed.
+	TargetUnfollowed TargetState = "unfollowed"
+)
+
+// State returns the lifecycle state of the target.
+func (t *Target) State() TargetState {
+	if t.Deleted {
+		return TargetUnfollowed
+	}
+	if t.Followed {
+		return TargetFollowed
+	}
+	return TargetPending
+}
+
+// dbOp is a single change inside a transaction.
+type dbOp struct {
+	Delete bool            `json:"delete,omitempty"`
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// DBStore is an embedded key/value Store kept in a single append-only file.
+// Every write is a transaction that is appended and synced to disk; a
+// transaction that was only partially written at the end of the file when
+// the process died is discarded the next time the file is opened. Damage
+// anywhere else fails the open and leaves the file as it is.
+type DBStore struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	size       int64
+	buckets    map[string]map[string]json.RawMessage
+	byState    map[TargetState]map[string]bool
+	eventSeq   int
+	journalSeq int
+	auditSeq   int
+	// live is the size of the keys and values of the live records, which
+	// the file is compacted to.
+	live int64
+	// damage is the damaged transaction found by a store opened for
+	// checking. Nothing is written while it is set.
+	damage *dbDamage
+}
+
+// dbDamage is a transaction that cannot be read. err is errTornFrame for
+// an incomplete transaction at the end of the file.
+type dbDamage struct {
+	offset int64
+	err    error
+}
+
+// OpenDBStore opens the database file at path, creating it if needed.
+func OpenDBStore(path string) (*DBStore, error) {
+	return openDBStore(path, false)
+}
+
+// openDBStore opens the database file at path. With check, the file must
+// exist and is not written: the schema is not migrated and the transactions
+// before a damaged or incomplete one are loaded, for Fsck.
+func openDBStore(path string, check bool) (*DBStore, error) {
+	flag := os.O_RDWR
+	if !check {
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE
+	}
+
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &DBStore{
+		path:    path,
+		file:    file,
+		buckets: make(map[string]map[string]json.RawMessage),
+		byState: make(map[TargetState]map[string]bool),
+	}
+	if err := s.replay(check); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if check {
+		return s, nil
+	}
+	if err := s.migrate(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// SchemaVersion returns the schema version recorded in the database.
+func (s *DBStore) SchemaVersion() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.schemaVersion()
+}
+
+func (s *DBStore) schemaVersion() (int, error) {
+	value, ok := s.buckets[bucketMeta]["schema_version"]
+	if !ok {
+		return 0, nil
+	}
+	var version int
+	if err := json.Unmarshal(value, &version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+func (s *DBStore) setSchemaVersion(version int) error {
+	value, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	return s.commit([]dbOp{{Bucket: bucketMeta, Key: "schema_version", Value: value}})
+}
+
+// migrate records the schema version of a new database and refuses
+// databases written by a newer version.
+func (s *DBStore) migrate() error {
+	version, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > DBSchemaVersion {
+		return fmt.Errorf("store schema version %v is newer than the supported version %v", version, DBSchemaVersion)
+	}
+	if version == DBSchemaVersion {
+		return nil
+	}
+	return s.setSchemaVersion(DBSchemaVersion)
+}
+
+// Close closes the database file.
+func (s *DBStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// LoadTargets ...
+func (s *DBStore) LoadTargets() ([]*Target, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var targets []*Target
+	for _, value := range s.buckets[bucketTargets] {
+		target := new(Target)
+		if err := json.Unmarshal(value, target); err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// SaveTargets writes the targets that changed and removes the ones that are
+// gone in a single transaction.
+func (s *DBStore) SaveTargets(targets []*Target) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ops []dbOp
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		value, err := json.Marshal(target)
+		if err != nil {
+			return err
+		}
+		seen[target.Username] = true
+		if bytes.Equal(s.buckets[bucketTargets][target.Username], value) {
+			continue
+		}
+		ops = append(ops, dbOp{Bucket: bucketTargets, Key: target.Username, Value: value})
+	}
+	for username := range s.buckets[bucketTargets] {
+		if !seen[username] {
+			ops = append(ops, dbOp{Delete: true, Bucket: bucketTargets, Key: username})
+		}
+	}
+
+	return s.commit(ops)
+}
+
+// UpdateTarget writes a single target.
+func (s *DBStore) UpdateTarget(target *Target) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, err := json.Marshal(target)
+	if err != nil {
+		return err
+	}
+	return s.commit([]dbOp{{Bucket: bucketTargets, Key: target.Username, Value: value}})
+}
+
+// TargetsByState returns the targets in the given state, sorted by username.
+func (s *DBStore) TargetsByState(state TargetState) ([]*Target, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var usernames []string
+	for username := range s.byState[state] {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var targets []*Target
+	for _, username := range usernames {
+		target := new(Target)
+		if err := json.Unmarshal(s.buckets[bucketTargets][username], target); err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// LoadBaseline ...
+func (s *DBStore) LoadBaseline(kind BaselineKind) ([]string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.buckets[bucketBaselines][string(kind)]
+	if !ok {
+		return nil, false, nil
+	}
+
+	var usernames []string
+	if err := json.Unmarshal(value, &usernames); err != nil {
+		return nil, false, err
+	}
+	return usernames, true, nil
+}
+
+// SaveBaseline ...
+func (s *DBStore) SaveBaseline(kind BaselineKind, usernames []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if usernames == nil {
+		usernames = []string{}
+	}
+	value, err := json.Marshal(usernames)
+	if err != nil {
+		return err
+	}
+	return s.commit([]dbOp{{Bucket: bucketBaselines, Key: string(kind), Value: value}})
+}
+
+// RecordEvent ...
+func (s *DBStore) RecordEvent(event *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%012d", s.eventSeq+1)
+	return s.commit([]dbOp{{Bucket: bucketEvents, Key: key, Value: value}})
+}
+
+// LoadEvents ...
+func (s *DBStore) LoadEvents() ([]*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []*Event
+	for _, key := range sortedKeys(s.buckets[bucketEvents]) {
+		event := new(Event)
+		if err := json.Unmarshal(s.buckets[bucketEvents][key], event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// AppendJournal ...
+func (s *DBStore) AppendJournal(entry *JournalEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%012d", s.journalSeq+1)
+	return s.commit([]dbOp{{Bucket: bucketJournal, Key: key, Value: value}})
+}
+
+// LoadJournal ...
+func (s *DBStore) LoadJournal() ([]*JournalEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []*JournalEntry
+	for _, key := range sortedKeys(s.buckets[bucketJournal]) {
+		entry := new(JournalEntry)
+		if err := json.Unmarshal(s.buckets[bucketJournal][key], entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ClearJournal ...
+func (s *DBStore) ClearJournal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ops []dbOp
+	for key := range s.buckets[bucketJournal] {
+		ops = append(ops, dbOp{Delete: true, Bucket: bucketJournal, Key: key})
+	}
+	return s.commit(ops)
+}
+
+// SaveSnapshot ...
+func (s *DBStore) SaveSnapshot(snapshot *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return s.commit([]dbOp{{Bucket: bucketSnapshots, Key: snapshot.ID, Value: value}})
+}
+
+// ListSnapshots ...
+func (s *DBStore) ListSnapshots() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return sortedKeys(s.buckets[bucketSnapshots]), nil
+}
+
+// LoadSnapshot ...
+func (s *DBStore) LoadSnapshot(id string) (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.buckets[bucketSnapshots][id]
+	if !ok {
+		return nil, fmt.Errorf("snapshot %q not found", id)
+	}
+	snapshot := new(Snapshot)
+	if err := json.Unmarshal(value, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// DeleteSnapshot ...
+func (s *DBStore) DeleteSnapshot(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[bucketSnapshots][id]; !ok {
+		return nil
+	}
+	return s.commit([]dbOp{{Delete: true, Bucket: bucketSnapshots, Key: id}})
+}
+
+// AppendAudit ...
+func (s *DBStore) AppendAudit(entry *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%012d", s.auditSeq+1)
+	return s.commit([]dbOp{{Bucket: bucketAudit, Key: key, Value: value}})
+}
+
+// LoadAudit ...
+func (s *DBStore) LoadAudit(filter *AuditFilter) ([]*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []*AuditEntry
+	for _, key := range sortedKeys(s.buckets[bucketAudit]) {
+		entry := new(AuditEntry)
+		if err := json.Unmarshal(s.buckets[bucketAudit][key], entry); err != nil {
+			return nil, err
+		}
+		if filter.Match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// empty reports whether nothing has been written to the store yet.
+func (s *DBStore) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.buckets[bucketTargets]) == 0 && len(s.buckets[bucketBaselines]) == 0
+}
+
+// migrated reports whether the store was migrated from a CSV store.
+func (s *DBStore) migrated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.buckets[bucketMeta]["migrated_from"]
+	return ok
+}
+
+// migrateFrom copies the state and journal of a CSV store in one
+// transaction, so a crash leaves the store either empty or fully migrated.
+func (s *DBStore) migrateFrom(src *CSVStore) error {
+	state, err := ExportState(src)
+	if err != nil {
+		return err
+	}
+	journal, err := src.LoadJournal()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ops []dbOp
+	add := func(bucket, key string, v interface{}) error {
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, dbOp{Bucket: bucket, Key: key, Value: value})
+		return nil
+	}
+	for _, target := range state.Targets {
+		if err := add(bucketTargets, target.Username, target); err != nil {
+			return err
+		}
+	}
+	for kind, usernames := range state.Baselines {
+		if usernames == nil {
+			usernames = []string{}
+		}
+		if err := add(bucketBaselines, string(kind), usernames); err != nil {
+			return err
+		}
+	}
+	for _, snapshot := range state.Snapshots {
+		if err := add(bucketSnapshots, snapshot.ID, snapshot); err != nil {
+			return err
+		}
+	}
+	for i, event := range state.Events {
+		if err := add(bucketEvents, fmt.Sprintf("%012d", s.eventSeq+i+1), event); err != nil {
+			return err
+		}
+	}
+	for i, entry := range state.Audit {
+		if err := add(bucketAudit, fmt.Sprintf("%012d", s.auditSeq+i+1), entry); err != nil {
+			return err
+		}
+	}
+	for i, entry := range journal {
+		if err := add(bucketJournal, fmt.Sprintf("%012d", s.journalSeq+i+1), entry); err != nil {
+			return err
+		}
+	}
+	if err := add(bucketMeta, "migrated_from", src.dir); err != nil {
+		return err
+	}
+	return s.commit(ops)
+}
+
+// commit appends the operations as one transaction, syncs the file and then
+// applies them in memory. Must be called with the lock held.
+func (s *DBStore) commit(ops []dbOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if s.file == nil {
+		return ErrStoreClosed
+	}
+	if s.damage != nil {
+		return fmt.Errorf("damaged transaction at offset %v in %s, run fsck -repair", s.damage.offset, s.path)
+	}
+
+	frame, err := encodeFrame(ops)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.WriteAt(frame, s.size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(frame))
+
+	for _, op := range ops {
+		s.apply(op)
+	}
+
+	// The transaction is durable, a failed compaction only leaves the file
+	// larger.
+	if err := s.maybeCompact(); err != nil {
+		log.Errorf("compact %s error: %v", s.path, err)
+	}
+	return nil
+}
+
+// replay loads every complete transaction from the file and truncates a
+// trailing partial one. A damaged transaction that does not reach the end
+// of the file is not a crash during a write, so it is returned as an error.
+// If check is set, both are recorded for Fsck instead.
+func (s *DBStore) replay(check bool) error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		ops, n, err := decodeFrame(r, info.Size()-offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && check {
+			// Nothing is written when checking, not even the truncation of
+			// an incomplete transaction.
+			s.damage = &dbDamage{offset: offset, err: err}
+			break
+		}
+		if err == errTornFrame {
+			log.Warnf("discarding incomplete transaction at offset %v in %s", offset, s.path)
+			if err := s.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("damaged transaction at offset %v in %s: %v, run fsck", offset, s.path, err)
+		}
+		for _, op := range ops {
+			s.apply(op)
+		}
+		offset += int64(n)
+	}
+
+	s.size = offset
+	return nil
+}
+
+// apply applies an operation to the in-memory buckets and indexes.
+func (s *DBStore) apply(op dbOp) {
+	bucket, ok := s.buckets[op.Bucket]
+	if !ok {
+		bucket = make(map[string]json.RawMessage)
+		s.buckets[op.Bucket] = bucket
+	}
+
+	if op.Bucket == bucketTargets {
+		for _, usernames := range s.byState {
+			delete(usernames, op.Key)
+		}
+	}
+
+	if old, ok := bucket[op.Key]; ok {
+		s.live -= int64(len(op.Key) + len(old))
+	}
+	if op.Delete {
+		delete(bucket, op.Key)
+		return
+	}
+	bucket[op.Key] = op.Value
+	s.live += int64(len(op.Key) + len(op.Value))
+
+	switch op.Bucket {
+	case bucketTargets:
+		target := new(Target)
+		if err := json.Unmarshal(op.Value, target); err != nil {
+			return
+		}
+		state := target.State()
+		if s.byState[state] == nil {
+			s.byState[state] = make(map[string]bool)
+		}
+		s.byState[state][op.Key] = true
+	case bucketEvents:
+		s.eventSeq = maxSeq(s.eventSeq, op.Key)
+	case bucketJournal:
+		s.journalSeq = maxSeq(s.journalSeq, op.Key)
+	case bucketAudit:
+		s.auditSeq = maxSeq(s.auditSeq, op.Key)
+	}
+}
+
+// maybeCompact rewrites the file with only the live records once it has grown
+// to more than twice their size.
+func (s *DBStore) maybeCompact() error {
+	if s.size < dbCompactMinSize || s.size < 2*s.live {
+		return nil
+	}
+
+	var ops []dbOp
+	for name, bucket := range s.buckets {
+		for key, value := range bucket {
+			ops = append(ops, dbOp{Bucket: name, Key: key, Value: value})
+		}
+	}
+
+	frame, err := encodeFrame(ops)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := writeSynced(tmp, frame); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Windows cannot replace a file that is open, so the database is closed
+	// for the rename and opened again, compacted or not, after it.
+	s.file.Close()
+	renameErr := os.Rename(tmp, s.path)
+	if renameErr != nil {
+		os.Remove(tmp)
+	}
+	file, err := os.OpenFile(s.path, os.O_RDWR, 0644)
+	if err != nil {
+		s.file = nil
+		return err
+	}
+	s.file = file
+	if renameErr != nil {
+		return renameErr
+	}
+
+	s.size = int64(len(frame))
+	log.Printf("compacted %s", s.path)
+	return syncDir(filepath.Dir(s.path))
+}
+
+// writeSynced writes data to a new file at path and syncs it.
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func sortedKeys(bucket map[string]json.RawMessage) []string {
+	var keys []string
+	for key := range bucket {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// maxSeq returns the larger of seq and the sequence number in key.
+func maxSeq(seq int, key string) int {
+	var n int
+	fmt.Sscanf(key, "%d", &n)
+	if n > seq {
+		return n
+	}
+	return seq
+}
+
+func encodeFrame(ops []dbOp) ([]byte, error) {
+	payload, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, dbFrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], dbFrameMagic)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[8:12], crc32.ChecksumIEEE(frame[0:8]))
+	binary.BigEndian.PutUint32(frame[12:16], crc32.ChecksumIEEE(payload))
+	copy(frame[dbFrameHeaderSize:], payload)
+	return frame, nil
+}
+
+// decodeFrame reads a transaction. remaining is the number of bytes from the
+// frame to the end of the file. It returns io.EOF at the end of the file and
+// errTornFrame for a last transaction that was cut short.
+func decodeFrame(r io.Reader, remaining int64) ([]dbOp, int, error) {
+	if remaining == 0 {
+		return nil, 0, io.EOF
+	}
+	if remaining < dbFrameHeaderSize {
+		return nil, 0, errTornFrame
+	}
+	header := make([]byte, dbFrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != dbFrameMagic {
+		return nil, 0, errors.New("not a transaction")
+	}
+	if crc32.ChecksumIEEE(header[0:8]) != binary.BigEndian.Uint32(header[8:12]) {
+		return nil, 0, errors.New("header checksum mismatch")
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[4:8]))
+	if size > remaining-dbFrameHeaderSize {
+		return nil, 0, errTornFrame
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[12:16]) {
+		if size == remaining-dbFrameHeaderSize {
+			// The last transaction, its payload was not completely
+			// written.
+			return nil, 0, errTornFrame
+		}
+		return nil, 0, errors.New("checksum mismatch")
+	}
+
+	var ops []dbOp
+	if err := json.Unmarshal(payload, &ops); err != nil {
+		return nil, 0, err
+	}
+	return ops, dbFrameHeaderSize + len(payload), nil
+}
@@ -0,0 +1,406 @@
+package gibot
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func openTestDB(t *testing.T, path string) *DBStore {
+	t.Helper()
+	store, err := OpenDBStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func targetNames(targets []*Target) []string {
+	var names []string
+	for _, target := range targets {
+		names = append(names, target.Username)
+	}
+	return names
+}
+
+func TestDBStoreTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gibot.db")
+	store := openTestDB(t, path)
+	if err := store.UpdateTarget(&Target{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	size := fileSize(t, path)
+
+	// A transaction cut short by a crash.
+	frame, err := encodeFrame([]dbOp{{Bucket: bucketTargets, Key: "bob", Value: []byte(`{"username":"bob"}`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(frame[:len(frame)-3])
+	f.Close()
+
+	store = openTestDB(t, path)
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := targetNames(targets); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Errorf("targets = %v, want [alice]", got)
+	}
+	if got := fileSize(t, path); got != size {
+		t.Errorf("size = %v, want the torn transaction truncated to %v", got, size)
+	}
+}
+
+func TestDBStoreCorruptionInMiddle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gibot.db")
+	store := openTestDB(t, path)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if err := store.UpdateTarget(&Target{Username: username}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte in the payload of the first transaction after the schema
+	// version.
+	i := strings.Index(string(data), "alice")
+	data[i] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenDBStore(path)
+	if err == nil || !strings.Contains(err.Error(), "fsck") {
+		t.Fatalf("open error = %v, want a damaged transaction error", err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(data) {
+		t.Errorf("damaged file was modified, %v bytes, want %v", len(after), len(data))
+	}
+}
+
+// writeTargetsDB writes a database with one transaction per target and
+// returns its contents and the offsets of the transactions.
+func writeTargetsDB(t *testing.T, path string, usernames ...string) ([]byte, []int) {
+	t.Helper()
+	store := openTestDB(t, path)
+	for _, username := range usernames {
+		if err := store.UpdateTarget(&Target{Username: username}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int
+	for offset := 0; offset < len(data); {
+		offsets = append(offsets, offset)
+		offset += dbFrameHeaderSize + int(binary.BigEndian.Uint32(data[offset+4:offset+8]))
+	}
+	return data, offsets
+}
+
+func TestDBStoreDamagedLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gibot.db")
+	data, offsets := writeTargetsDB(t, path, "alice", "bob", "carol")
+	// The length of bob's transaction, the schema version comes first.
+	data[offsets[2]+7] ^= 0x01
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenDBStore(path); err == nil || !strings.Contains(err.Error(), "fsck") {
+		t.Fatalf("open error = %v, want a damaged transaction error", err)
+	}
+	store, err := openDBStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.damage == nil || store.damage.offset != int64(offsets[2]) || store.damage.err == errTornFrame {
+		t.Errorf("damage = %+v, want damage at offset %v", store.damage, offsets[2])
+	}
+	targets, _ := store.LoadTargets()
+	if got := targetNames(targets); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Errorf("targets before the damage = %v, want [alice]", got)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(data) {
+		t.Errorf("damaged file was modified, %v bytes, want %v", len(after), len(data))
+	}
+}
+
+func TestDBStoreTornLastPayload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gibot.db")
+	data, offsets := writeTargetsDB(t, path, "alice", "bob")
+	// Blocks of the last transaction that never made it to disk.
+	last := offsets[len(offsets)-1]
+	for i := last + dbFrameHeaderSize; i < len(data); i++ {
+		data[i] = 0
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Checking leaves the file alone.
+	check, err := openDBStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.damage == nil || check.damage.err != errTornFrame {
+		t.Errorf("damage = %+v, want an incomplete transaction", check.damage)
+	}
+	check.Close()
+	if got := fileSize(t, path); got != int64(len(data)) {
+		t.Fatalf("check changed the size to %v, want %v", got, len(data))
+	}
+
+	store := openTestDB(t, path)
+	targets, _ := store.LoadTargets()
+	if got := targetNames(targets); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Errorf("targets = %v, want [alice]", got)
+	}
+	if got := fileSize(t, path); got != int64(last) {
+		t.Errorf("size = %v, want the torn transaction truncated to %v", got, last)
+	}
+}
+
+func TestDBStoreCompactReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gibot.db")
+	store := openTestDB(t, path)
+	query := strings.Repeat("q", 10000)
+	// Rewrite the target until the file outgrows the live records and is
+	// compacted.
+	var last int
+	compacted := false
+	for last = 0; last < 1000 && !compacted; last++ {
+		before := fileSize(t, path)
+		if err := store.UpdateTarget(&Target{Username: "alice", Query: query, Attempts: last}); err != nil {
+			t.Fatal(err)
+		}
+		compacted = fileSize(t, path) < before
+	}
+	last--
+	if !compacted {
+		t.Fatal("store was not compacted")
+	}
+	// The store writes to the compacted file, reopened after the rename.
+	open, err := store.file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(open, onDisk) {
+		t.Error("store is not writing to the compacted file")
+	}
+	if err := store.RecordEvent(&Event{Type: EventFollowed, Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("compaction left %s.tmp behind", path)
+	}
+
+	store = openTestDB(t, path)
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Attempts != last {
+		t.Fatalf("targets after reopen = %+v, want alice with %v attempts", targets, last)
+	}
+	events, err := store.LoadEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("events after reopen = %v, want 1", len(events))
+	}
+	version, err := store.SchemaVersion()
+	if err != nil || version != DBSchemaVersion {
+		t.Errorf("schema version after reopen = %v, %v", version, err)
+	}
+}
+
+// liveSize returns the size of the live records of the store.
+func liveSize(store *DBStore) int64 {
+	var live int64
+	for _, bucket := range store.buckets {
+		for key, value := range bucket {
+			live += int64(len(key) + len(value))
+		}
+	}
+	return live
+}
+
+func TestDBStoreLiveSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gibot.db")
+	store := openTestDB(t, path)
+	if err := store.UpdateTarget(&Target{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateTarget(&Target{Username: "alice", Query: "language:go", Followed: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AppendJournal(&JournalEntry{Action: JournalFollow, Username: "bob", Phase: JournalIntent}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ClearJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := store.live, liveSize(store); got != want {
+		t.Errorf("live size = %v, want %v", got, want)
+	}
+	store.Close()
+
+	store = openTestDB(t, path)
+	if got, want := store.live, liveSize(store); got != want {
+		t.Errorf("live size after reopen = %v, want %v", got, want)
+	}
+}
+
+func TestDBStoreTargetsByState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gibot.db")
+	store := openTestDB(t, path)
+	err := store.SaveTargets([]*Target{
+		{Username: "carol"},
+		{Username: "alice"},
+		{Username: "bob", Followed: true},
+		{Username: "dave", Followed: true, Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateTarget(&Target{Username: "carol", Followed: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(store *DBStore) {
+		t.Helper()
+		for state, want := range map[TargetState][]string{
+			TargetPending:    {"alice"},
+			TargetFollowed:   {"bob", "carol"},
+			TargetUnfollowed: {"dave"},
+		} {
+			targets, err := store.TargetsByState(state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := targetNames(targets); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s targets = %v, want %v", state, got, want)
+			}
+		}
+	}
+	check(store)
+
+	// The index is rebuilt from the file.
+	store.Close()
+	check(openTestDB(t, path))
+}
+
+func TestOpenStoreMigratesCSV(t *testing.T) {
+	dir := t.TempDir()
+	src := NewCSVStore(dir)
+	if err := src.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SaveTargets([]*Target{{Username: "alice", Followed: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SaveBaseline(BaselineFollowing, []string{"bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AppendJournal(&JournalEntry{Action: JournalFollow, Phase: JournalIntent, Username: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "gibot.db")
+	store, err := openStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := store.(*DBStore)
+	targets, _ := db.LoadTargets()
+	following, found, _ := db.LoadBaseline(BaselineFollowing)
+	journal, _ := db.LoadJournal()
+	if got := targetNames(targets); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Errorf("migrated targets = %v", got)
+	}
+	if !found || !reflect.DeepEqual(following, []string{"bob"}) {
+		t.Errorf("migrated following baseline = %v, %v", following, found)
+	}
+	if len(journal) != 1 || journal[0].Username != "carol" {
+		t.Errorf("migrated journal = %+v", journal)
+	}
+	if !db.migrated() {
+		t.Error("store not marked as migrated")
+	}
+	db.Close()
+
+}
+
+func TestOpenStoreMigratesCSVOnce(t *testing.T) {
+	// A CSV store without targets or baselines leaves the database empty.
+	dir := t.TempDir()
+	src := NewCSVStore(dir)
+	if err := src.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SaveTargets(nil); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "gibot.db")
+	store, err := openStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.(*DBStore).Close()
+
+	if err := src.SaveTargets([]*Target{{Username: "eve"}}); err != nil {
+		t.Fatal(err)
+	}
+	store, err = openStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.(*DBStore).Close()
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 0 {
+		t.Errorf("targets after reopen = %v, want none migrated again", targetNames(targets))
+	}
+}
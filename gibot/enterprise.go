@@ -0,0 +1,73 @@
+package gibot
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// enterpriseURLs completes the API URLs of a GitHub Enterprise Server. A
+// base URL without a path gets the /api/v3/ prefix, and the upload URL
+// defaults to the server's /api/uploads/.
+func enterpriseURLs(baseURL, uploadURL string) (string, string, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", "", err
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return "", "", fmt.Errorf("invalid base URL %q", baseURL)
+	}
+	if base.Path == "" || base.Path == "/" {
+		base.Path = "/api/v3/"
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+
+	if uploadURL == "" {
+		upload := *base
+		upload.Path = "/api/uploads/"
+		uploadURL = upload.String()
+	}
+	return base.String(), uploadURL, nil
+}
+
+// graphQLURL returns the GraphQL endpoint relative to the REST base URL. It
+// is /graphql on GitHub.com and /api/graphql on GitHub Enterprise Server.
+func graphQLURL(baseURL *url.URL) string {
+	if strings.HasSuffix(baseURL.Path, "/api/v3/") {
+		return "../graphql"
+	}
+	return "graphql"
+}
+
+// newTransport returns the transport of API requests. It trusts the
+// certificates in the PEM file caBundle, if set, in addition to the system
+// roots.
+func newTransport(caBundle string) (http.RoundTripper, error) {
+	if caBundle == "" {
+		return http.DefaultTransport, nil
+	}
+
+	pem, err := os.ReadFile(NormalizePath(caBundle))
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", caBundle)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs: pool,
+	}
+	return transport, nil
+}
@@ -0,0 +1,265 @@
+package gibot
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnterpriseURLs(t *testing.T) {
+	for _, test := range []struct {
+		base, upload         string
+		wantBase, wantUpload string
+	}{
+		{"https://ghe.example.com", "", "https://ghe.example.com/api/v3/", "https://ghe.example.com/api/uploads/"},
+		{"https://ghe.example.com/", "", "https://ghe.example.com/api/v3/", "https://ghe.example.com/api/uploads/"},
+		{"https://ghe.example.com/api/v3", "", "https://ghe.example.com/api/v3/", "https://ghe.example.com/api/uploads/"},
+		{"https://ghe.example.com:8443/github/api/v3/", "https://uploads.example.com/", "https://ghe.example.com:8443/github/api/v3/", "https://uploads.example.com/"},
+	} {
+		base, upload, err := enterpriseURLs(test.base, test.upload)
+		if err != nil {
+			t.Errorf("enterpriseURLs(%q, %q) error: %v", test.base, test.upload, err)
+			continue
+		}
+		if base != test.wantBase || upload != test.wantUpload {
+			t.Errorf("enterpriseURLs(%q, %q) = %q, %q, want %q, %q", test.base, test.upload, base, upload, test.wantBase, test.wantUpload)
+		}
+	}
+
+	for _, base := range []string{"ghe.example.com", "/api/v3/", "https://ghe.example.com/%zz"} {
+		if _, _, err := enterpriseURLs(base, ""); err == nil {
+			t.Errorf("enterpriseURLs(%q) did not fail", base)
+		}
+	}
+}
+
+func TestGraphQLURL(t *testing.T) {
+	for base, want := range map[string]string{
+		"https://api.github.com/":         "graphql",
+		"https://ghe.example.com/api/v3/": "../graphql",
+	} {
+		u, err := url.Parse(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := graphQLURL(u); got != want {
+			t.Errorf("graphQLURL(%q) = %q, want %q", base, got, want)
+		}
+		if resolved := u.ResolveReference(&url.URL{Path: want}).Path; resolved != "/graphql" && resolved != "/api/graphql" {
+			t.Errorf("GraphQL endpoint of %q is %q", base, resolved)
+		}
+	}
+}
+
+func TestNewTransportCABundleErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTransport(filepath.Join(dir, "missing.pem")); !os.IsNotExist(err) {
+		t.Errorf("missing bundle error = %v, want not exist", err)
+	}
+	if _, err := newTransport(empty); err == nil || !strings.Contains(err.Error(), "no certificates found") {
+		t.Errorf("bundle without certificates error = %v, want no certificates found", err)
+	}
+	if transport, err := newTransport(""); err != nil || transport != http.DefaultTransport {
+		t.Errorf("no bundle = %v, %v, want the default transport", transport, err)
+	}
+}
+
+// newTestCA returns a TLS config for 127.0.0.1 with a certificate signed by a
+// new CA, and the CA certificate as PEM.
+func newTestCA(t *testing.T) (*tls.Config, []byte) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gibot test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err = x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ghe.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leafDER}, PrivateKey: key}},
+	}
+	return config, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+}
+
+// newEnterpriseBot returns a bot of bob on the GitHub Enterprise Server at
+// baseURL.
+func newEnterpriseBot(t *testing.T, baseURL, caBundle string) (*Bot, error) {
+	t.Helper()
+	bot, err := NewBot(&Config{
+		AccessToken:  "ghp_test",
+		Username:     "bob",
+		Store:        NewMemoryStore(),
+		BaseURL:      baseURL,
+		CABundle:     caBundle,
+		DisableCache: true,
+		GraphQL:      true,
+		Retry:        RetryPolicy{MaxRetries: -1},
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { bot.Close() })
+	setTestClock(bot, time.Now())
+	return bot, nil
+}
+
+func TestEnterpriseCABundle(t *testing.T) {
+	server := httptest.NewUnstartedServer(&identityServer{login: "bob"})
+	tlsConfig, caPEM := newTestCA(t)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bot, err := newEnterpriseBot(t, server.URL, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.preflight(context.Background(), false); err != nil {
+		t.Errorf("preflight with the CA bundle: %v", err)
+	}
+
+	untrusted, err := newEnterpriseBot(t, server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = untrusted.preflight(context.Background(), false)
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("preflight without the CA bundle error = %v, want an unknown authority", err)
+	}
+}
+
+// oldEnterpriseServer is a GitHub Enterprise Server without rate limiting,
+// GraphQL or search qualifiers, where alice is active.
+func oldEnterpriseServer(t *testing.T) http.Handler {
+	recent := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	mux := http.NewServeMux()
+	mux.Handle("/api/v3/user", &identityServer{login: "bob"})
+	for _, path := range []string{"/api/v3/users/bob/followers", "/api/v3/users/bob/following"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `[]`)
+		})
+	}
+	mux.HandleFunc("/api/v3/search/users", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Query().Get("q"), ":") {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(w, `{"message": "Validation Failed"}`)
+			return
+		}
+		fmt.Fprint(w, `{"total_count": 1, "incomplete_results": false, "items": [{"login": "alice", "id": 2}]}`)
+	})
+	mux.HandleFunc("/api/v3/users/alice/events", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"type": "PushEvent", "created_at": %q}, {"type": "WatchEvent", "created_at": %q}]`, recent, recent)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// The rate limit and GraphQL endpoints are missing.
+		if r.URL.Path != "/api/v3/rate_limit" && r.URL.Path != "/api/graphql" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		http.NotFound(w, r)
+	})
+	return mux
+}
+
+func TestOldEnterpriseServerFallbacks(t *testing.T) {
+	server := httptest.NewServer(oldEnterpriseServer(t))
+	defer server.Close()
+	bot, err := newEnterpriseBot(t, server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bot.Start(context.Background(), &StartConfig{
+		Search:  true,
+		Queries: []string{"language:go", "gopher"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice := bot.targets["alice"]; alice == nil || alice.Query != "gopher" || alice.RecentEvents != 2 {
+		t.Errorf("alice = %+v, want found by the query without qualifiers", alice)
+	}
+	if bot.graphQL {
+		t.Error("GraphQL still used after the server did not support it")
+	}
+}
+
+func TestRejectedSearchOnlySkippedOnEnterprise(t *testing.T) {
+	for _, enterprise := range []bool{false, true} {
+		fake := NewFakeClient("bob")
+		_, rejected := githubError(http.StatusUnprocessableEntity)
+		fake.SetError("SearchUsers", rejected)
+		store := NewMemoryStore()
+		store.SaveBaseline(BaselineFollowers, nil)
+		store.SaveBaseline(BaselineFollowing, nil)
+		bot := newTestBot(t, fake, store)
+		bot.enterprise = enterprise
+
+		err := bot.Start(context.Background(), &StartConfig{Search: true, Queries: []string{"language:go"}})
+		if enterprise && err != nil {
+			t.Errorf("rejected search on GitHub Enterprise Server: %v, want skipped", err)
+		}
+		if !enterprise && !errors.Is(err, rejected) {
+			t.Errorf("rejected search on GitHub.com error = %v, want %v", err, rejected)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package gibot
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// StateVersion is the version of the exported state format.
+const StateVersion = 1
+
+// Export formats.
+const (
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+)
+
+// NDJSON record types.
+const (
+	recordHeader   = "header"
+	recordTarget   = "target"
+	recordBaseline = "baseline"
+	recordSnapshot = "snapshot"
+	recordEvent    = "event"
+	recordAudit    = "audit"
+)
+
+// State is everything the bot keeps in its store.
+type State struct {
+	Version    int                       `json:"version"`
+	ExportedAt time.Time                 `json:"exported_at"`
+	Targets    []*Target                 `json:"targets"`
+	Baselines  map[BaselineKind][]string `json:"baselines"`
+	Snapshots  []*Snapshot               `json:"snapshots"`
+	Events     []*Event                  `json:"events"`
+	Audit      []*AuditEntry             `json:"audit"`
+}
+
+type ndjsonRecord struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type stateHeader struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+type baselineRecord struct {
+	Kind      BaselineKind `json:"kind"`
+	Usernames []string     `json:"usernames"`
+}
+
+// Export writes the state of the bot's store to w.
+func (b *Bot) Export(w io.Writer, format string) error {
+	state, err := ExportState(b.store)
+	if err != nil {
+		return err
+	}
+	return WriteState(w, state, format)
+}
+
+// Import reads a state exported by Export from r into the bot's store.
+func (b *Bot) Import(r io.Reader, format string) error {
+	state, err := ReadState(r, format)
+	if err != nil {
+		return err
+	}
+	return ImportState(b.store, state)
+}
+
+// ExportState reads the whole state of a store.
+func ExportState(store Store) (*State, error) {
+	state := &State{
+		Version:    StateVersion,
+		ExportedAt: time.Now().UTC(),
+		Baselines:  make(map[BaselineKind][]string),
+	}
+
+	var err error
+	state.Targets, err = store.LoadTargets()
+	if err != nil {
+		return nil, err
+	}
+	sortTargets(state.Targets)
+
+	for _, kind := range []BaselineKind{BaselineFollowers, BaselineFollowing} {
+		usernames, found, err := store.LoadBaseline(kind)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			state.Baselines[kind] = usernames
+		}
+	}
+
+	ids, err := store.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		snapshot, err := store.LoadSnapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		state.Snapshots = append(state.Snapshots, snapshot)
+	}
+
+	state.Events, err = store.LoadEvents()
+	if err != nil {
+		return nil, err
+	}
+
+	state.Audit, err = store.LoadAudit(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// ImportState writes a state into a store. Targets and baselines are
+// replaced, snapshots are added and events and audit entries already in the
+// store are skipped.
+func ImportState(store Store, state *State) error {
+	if state.Version > StateVersion {
+		return fmt.Errorf("state version %v is newer than the supported version %v", state.Version, StateVersion)
+	}
+
+	if err := store.SaveTargets(state.Targets); err != nil {
+		return err
+	}
+
+	for kind, usernames := range state.Baselines {
+		if err := store.SaveBaseline(kind, usernames); err != nil {
+			return err
+		}
+	}
+
+	for _, snapshot := range state.Snapshots {
+		if err := store.SaveSnapshot(snapshot); err != nil {
+			return err
+		}
+	}
+
+	existing, err := store.LoadEvents()
+	if err != nil {
+		return err
+	}
+	seen := make(map[Event]bool)
+	for _, event := range existing {
+		seen[eventKey(event)] = true
+	}
+	for _, event := range state.Events {
+		if seen[eventKey(event)] {
+			continue
+		}
+		if err := store.RecordEvent(event); err != nil {
+			return err
+		}
+	}
+
+	audit, err := store.LoadAudit(nil)
+	if err != nil {
+		return err
+	}
+	// Retries can share a key, so only the entries beyond the number already
+	// in the store are new.
+	seenAudit := make(map[string]int)
+	for _, entry := range audit {
+		seenAudit[auditKey(entry)]++
+	}
+	for _, entry := range state.Audit {
+		key := auditKey(entry)
+		if seenAudit[key] > 0 {
+			seenAudit[key]--
+			continue
+		}
+		if err := store.AppendAudit(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteState encodes a state as a single JSON document or as NDJSON, one
+// record per line.
+func WriteState(w io.Writer, state *State, format string) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(state)
+	case FormatNDJSON:
+		enc := json.NewEncoder(w)
+		write := func(recordType string, data interface{}) error {
+			raw, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			return enc.Encode(&ndjsonRecord{Type: recordType, Data: raw})
+		}
+
+		if err := write(recordHeader, &stateHeader{Version: state.Version, ExportedAt: state.ExportedAt}); err != nil {
+			return err
+		}
+		for _, target := range state.Targets {
+			if err := write(recordTarget, target); err != nil {
+				return err
+			}
+		}
+		for _, kind := range []BaselineKind{BaselineFollowers, BaselineFollowing} {
+			usernames, ok := state.Baselines[kind]
+			if !ok {
+				continue
+			}
+			if err := write(recordBaseline, &baselineRecord{Kind: kind, Usernames: usernames}); err != nil {
+				return err
+			}
+		}
+		for _, snapshot := range state.Snapshots {
+			if err := write(recordSnapshot, snapshot); err != nil {
+				return err
+			}
+		}
+		for _, event := range state.Events {
+			if err := write(recordEvent, event); err != nil {
+				return err
+			}
+		}
+		for _, entry := range state.Audit {
+			if err := write(recordAudit, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// ReadState decodes a state written by WriteState.
+func ReadState(r io.Reader, format string) (*State, error) {
+	switch format {
+	case FormatJSON:
+		state := new(State)
+		if err := json.NewDecoder(r).Decode(state); err != nil {
+			return nil, err
+		}
+		return state, nil
+	case FormatNDJSON:
+		state := &State{
+			Baselines: make(map[BaselineKind][]string),
+		}
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			if err := readNDJSONRecord(state, scanner.Bytes()); err != nil {
+				return nil, fmt.Errorf("line %v: %v", line, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return state, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func readNDJSONRecord(state *State, line []byte) error {
+	var record ndjsonRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return err
+	}
+
+	switch record.Type {
+	case recordHeader:
+		var header stateHeader
+		if err := json.Unmarshal(record.Data, &header); err != nil {
+			return err
+		}
+		state.Version = header.Version
+		state.ExportedAt = header.ExportedAt
+	case recordTarget:
+		target := new(Target)
+		if err := json.Unmarshal(record.Data, target); err != nil {
+			return err
+		}
+		state.Targets = append(state.Targets, target)
+	case recordBaseline:
+		var baseline baselineRecord
+		if err := json.Unmarshal(record.Data, &baseline); err != nil {
+			return err
+		}
+		state.Baselines[baseline.Kind] = baseline.Usernames
+	case recordSnapshot:
+		snapshot := new(Snapshot)
+		if err := json.Unmarshal(record.Data, snapshot); err != nil {
+			return err
+		}
+		state.Snapshots = append(state.Snapshots, snapshot)
+	case recordEvent:
+		event := new(Event)
+		if err := json.Unmarshal(record.Data, event); err != nil {
+			return err
+		}
+		state.Events = append(state.Events, event)
+	case recordAudit:
+		entry := new(AuditEntry)
+		if err := json.Unmarshal(record.Data, entry); err != nil {
+			return err
+		}
+		state.Audit = append(state.Audit, entry)
+	default:
+		return fmt.Errorf("unknown record type %q", record.Type)
+	}
+
+	return nil
+}
+
+// eventKey identifies an event regardless of the precision its time was
+// stored with.
+func eventKey(event *Event) Event {
+	return Event{
+		Time:     time.Unix(event.Time.Unix(), 0).UTC(),
+		Type:     event.Type,
+		Username: event.Username,
+		Message:  event.Message,
+	}
+}
+
+// auditKey identifies the audit entries of a call. Times are compared to the
+// second, which is what the CSV store keeps, so retries within a second share
+// a key.
+func auditKey(entry *AuditEntry) string {
+	return fmt.Sprintf("%v|%s|%s|%s", entry.Time.Unix(), entry.RunID, entry.Action, entry.Target)
+}
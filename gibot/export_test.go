@@ -0,0 +1,141 @@
+package gibot
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fillStore writes one of everything a store keeps.
+func fillStore(t *testing.T, store Store) {
+	t.Helper()
+	now := time.Unix(1577836800, 0)
+	followed := now.Add(time.Hour)
+	err := store.SaveTargets([]*Target{
+		{Username: "alice", Followed: true, FollowedDate: &followed, UserID: 1, Source: "search", Query: "language:go", Score: 1.5},
+		{Username: "bob", DiscoveredAt: &now, Attempts: 2, LastError: "not found"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveBaseline(BaselineFollowers, []string{"carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveBaseline(BaselineFollowing, []string{"carol", "dave"}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &Snapshot{ID: now.UTC().Format(snapshotIDFormat), Time: now.UTC(), Followers: []string{"carol"}, Following: []string{"dave"}}
+	if err := store.SaveSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RecordEvent(&Event{Time: followed, Type: EventFollowed, Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	reset := now.Add(2 * time.Hour)
+	err = store.AppendAudit(&AuditEntry{Time: followed, RunID: "run", Action: JournalFollow, Target: "alice", StatusCode: 204, RateLimit: 5000, RateRemaining: 4999, RateReset: &reset})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stateJSON exports a store without the export time, for comparison.
+func stateJSON(t *testing.T, store Store) string {
+	t.Helper()
+	state, err := ExportState(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.ExportedAt = time.Time{}
+	var buf bytes.Buffer
+	if err := WriteState(&buf, state, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := NewCSVStore(dir)
+	fillStore(t, src)
+
+	state, err := ExportState(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteState(&buf, state, FormatNDJSON); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadState(&buf, FormatNDJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := openTestDB(t, filepath.Join(dir, "gibot.db"))
+	if err := ImportState(dst, read); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := stateJSON(t, dst), stateJSON(t, src); got != want {
+		t.Errorf("imported state:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestImportSkipsExisting(t *testing.T) {
+	src := NewMemoryStore()
+	fillStore(t, src)
+	state, err := ExportState(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := openTestDB(t, filepath.Join(t.TempDir(), "gibot.db"))
+	if err := ImportState(dst, state); err != nil {
+		t.Fatal(err)
+	}
+
+	// Imported again with an event of its own.
+	added := &Event{Time: time.Unix(1577840400, 0), Type: EventUnfollowed, Username: "alice"}
+	state.Events = append(state.Events, added)
+	if err := ImportState(dst, state); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := dst.LoadEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1].Type != EventUnfollowed {
+		t.Errorf("events = %+v, want the followed event and the new one", events)
+	}
+	audit, err := dst.LoadAudit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audit) != 1 {
+		t.Errorf("%v audit entries, want 1", len(audit))
+	}
+}
+
+func TestImportKeepsRetries(t *testing.T) {
+	at := time.Unix(1577836800, 0)
+	state := &State{
+		Version: StateVersion,
+		Audit: []*AuditEntry{
+			{Time: at, RunID: "run", Action: JournalFollow, Target: "alice", StatusCode: 502, Error: "bad gateway"},
+			{Time: at.Add(300 * time.Millisecond), RunID: "run", Action: JournalFollow, Target: "alice", StatusCode: 204},
+		},
+	}
+	store := NewCSVStore(t.TempDir())
+	for i := 0; i < 2; i++ {
+		if err := ImportState(store, state); err != nil {
+			t.Fatal(err)
+		}
+		audit, err := store.LoadAudit(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(audit) != 2 || audit[0].StatusCode != 502 || audit[1].StatusCode != 204 {
+			t.Errorf("import %v: audit = %+v, want both attempts once", i+1, audit)
+		}
+	}
+}
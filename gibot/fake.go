@@ -0,0 +1,462 @@
+package gibot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// FakeClient is an in-memory Client that simulates users, follows, events
+// and search results, for running the bot without GitHub.
+type FakeClient struct {
+	mu       sync.Mutex
+	login    string
+	nextID   int64
+	users    map[string]*fakeUser
+	searches map[string][]string
+	errors   map[string]error
+	calls    map[string]int
+	scopes   *string
+}
+
+type fakeUser struct {
+	id        int64
+	following map[string]bool
+	events    []*github.Event
+}
+
+// NewFakeClient returns a FakeClient authenticated as login.
+func NewFakeClient(login string) *FakeClient {
+	c := &FakeClient{
+		login:    login,
+		users:    make(map[string]*fakeUser),
+		searches: make(map[string][]string),
+		errors:   make(map[string]error),
+		calls:    make(map[string]int),
+	}
+	c.AddUser(login)
+	return c
+}
+
+// SetScopes sets the token scopes reported by AuthenticatedUser. By default
+// the token has the user:follow scope.
+func (c *FakeClient) SetScopes(scopes ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := strings.Join(scopes, ", ")
+	c.scopes = &s
+}
+
+// AddUser adds users that do not exist yet.
+func (c *FakeClient) AddUser(logins ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, login := range logins {
+		c.user(login)
+	}
+}
+
+// SetFollowing makes user follow the targets, adding them if needed.
+func (c *FakeClient) SetFollowing(user string, targets ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u := c.user(user)
+	for _, target := range targets {
+		c.user(target)
+		u.following[target] = true
+	}
+}
+
+// AddEvents adds push events performed by user at the given times.
+func (c *FakeClient) AddEvents(user string, times ...time.Time) {
+	c.AddEventsOfType(user, "PushEvent", times...)
+}
+
+// AddEventsOfType adds events of a type, e.g. "WatchEvent", performed by
+// user at the given times.
+func (c *FakeClient) AddEventsOfType(user, eventType string, times ...time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u := c.user(user)
+	for _, t := range times {
+		t := t
+		u.events = append(u.events, &github.Event{
+			Type:      github.String(eventType),
+			CreatedAt: &t,
+		})
+	}
+	sort.Slice(u.events, func(i, j int) bool {
+		return u.events[i].CreatedAt.After(*u.events[j].CreatedAt)
+	})
+}
+
+// SetSearchResults sets the users returned for a search query, adding them
+// if needed.
+func (c *FakeClient) SetSearchResults(query string, logins ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, login := range logins {
+		c.user(login)
+	}
+	c.searches[query] = logins
+}
+
+// SetError makes every call of a Client method, e.g. "Follow", fail with
+// err. A nil err clears it. The call returns the response of go-github
+// errors that have one, and a 500 response otherwise.
+func (c *FakeClient) SetError(method string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		delete(c.errors, method)
+		return
+	}
+	c.errors[method] = err
+}
+
+// Calls returns the number of calls made to a Client method.
+func (c *FakeClient) Calls(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.calls[method]
+}
+
+// Following returns the users followed by user, sorted.
+func (c *FakeClient) Following(user string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var following []string
+	if u, ok := c.users[user]; ok {
+		for target := range u.following {
+			following = append(following, target)
+		}
+	}
+	sort.Strings(following)
+	return following
+}
+
+// ListFollowers ...
+func (c *FakeClient) ListFollowers(ctx context.Context, user string, opt *github.ListOptions) ([]*github.User, *github.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resp, err := c.call(ctx, "ListFollowers", user); err != nil {
+		return nil, resp, err
+	}
+
+	var followers []string
+	for login, u := range c.users {
+		if u.following[user] {
+			followers = append(followers, login)
+		}
+	}
+	sort.Strings(followers)
+	users, resp := c.page(followers, opt)
+	return users, resp, nil
+}
+
+// ListFollowing ...
+func (c *FakeClient) ListFollowing(ctx context.Context, user string, opt *github.ListOptions) ([]*github.User, *github.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resp, err := c.call(ctx, "ListFollowing", user); err != nil {
+		return nil, resp, err
+	}
+
+	var following []string
+	for login := range c.users[user].following {
+		following = append(following, login)
+	}
+	sort.Strings(following)
+	users, resp := c.page(following, opt)
+	return users, resp, nil
+}
+
+// IsFollowing ...
+func (c *FakeClient) IsFollowing(ctx context.Context, user, target string) (bool, *github.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resp, err := c.call(ctx, "IsFollowing", user, target); err != nil {
+		return false, resp, err
+	}
+
+	following := c.users[user].following[target]
+	if !following {
+		return false, fakeResponse(http.StatusNotFound), nil
+	}
+	return true, fakeResponse(http.StatusNoContent), nil
+}
+
+// Follow ...
+func (c *FakeClient) Follow(ctx context.Context, user string) (*github.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resp, err := c.call(ctx, "Follow", user); err != nil {
+		return resp, err
+	}
+
+	c.users[c.login].following[user] = true
+	return fakeResponse(http.StatusNoContent), nil
+}
+
+// Unfollow ...
+func (c *FakeClient) Unfollow(ctx context.Context, user string) (*github.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resp, err := c.call(ctx, "Unfollow", user); err != nil {
+		return resp, err
+	}
+
+	delete(c.users[c.login].following, user)
+	return fakeResponse(http.StatusNoContent), nil
+}
+
+// ListEventsPerformedByUser ...
+func (c *FakeClient) ListEventsPerformedByUser(ctx context.Context, user string, publicOnly bool, opt *github.ListOptions) ([]*github.Event, *github.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resp, err := c.call(ctx, "ListEventsPerformedByUser", user); err != nil {
+		return nil, resp, err
+	}
+
+	events := c.users[user].events
+	start, end, resp := pageBounds(len(events), opt)
+	return events[start:end], resp, nil
+}
+
+// SearchUsers returns the users set for the query with SetSearchResults.
+func (c *FakeClient) SearchUsers(ctx context.Context, query string, opt *github.SearchOptions) (*github.UsersSearchResult, *github.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resp, err := c.call(ctx, "SearchUsers"); err != nil {
+		return nil, resp, err
+	}
+
+	var listOptions *github.ListOptions
+	if opt != nil {
+		listOptions = &opt.ListOptions
+	}
+	logins := c.searches[query]
+	users, resp := c.page(logins, listOptions)
+	result := &github.UsersSearchResult{
+		Total:             github.Int(len(logins)),
+		IncompleteResults: github.Bool(false),
+	}
+	for _, user := range users {
+		result.Users = append(result.Users, *user)
+	}
+	return result, resp, nil
+}
+
+// Profiles returns the profiles of the users that exist, with whether the
+// fake's user follows them and they follow it.
+func (c *FakeClient) Profiles(ctx context.Context, logins []string) (map[string]*Profile, *github.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resp, err := c.call(ctx, "Profiles"); err != nil {
+		return nil, resp, err
+	}
+
+	profiles := make(map[string]*Profile)
+	for _, login := range logins {
+		u, ok := c.users[login]
+		if !ok {
+			continue
+		}
+		profiles[login] = &Profile{
+			Login:             login,
+			ID:                u.id,
+			ViewerIsFollowing: c.users[c.login].following[login],
+			IsFollowingViewer: u.following[c.login],
+		}
+	}
+	return profiles, fakeResponse(http.StatusOK), nil
+}
+
+// AuthenticatedUser returns the user the fake is authenticated as, with the
+// token scopes in the X-OAuth-Scopes header.
+func (c *FakeClient) AuthenticatedUser(ctx context.Context) (*github.User, *github.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resp, err := c.call(ctx, "AuthenticatedUser"); err != nil {
+		return nil, resp, err
+	}
+
+	resp := fakeResponse(http.StatusOK)
+	scopes := "user:follow"
+	if c.scopes != nil {
+		scopes = *c.scopes
+	}
+	resp.Header.Set("X-OAuth-Scopes", scopes)
+	return &github.User{
+		Login: github.String(c.login),
+		ID:    github.Int64(c.users[c.login].id),
+	}, resp, nil
+}
+
+// RateLimits returns full quotas that reset in an hour.
+func (c *FakeClient) RateLimits(ctx context.Context) (*github.RateLimits, *github.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resp, err := c.call(ctx, "RateLimits"); err != nil {
+		return nil, resp, err
+	}
+
+	reset := github.Timestamp{Time: time.Now().Add(time.Hour)}
+	return &github.RateLimits{
+		Core:   &github.Rate{Limit: 5000, Remaining: 5000, Reset: reset},
+		Search: &github.Rate{Limit: 30, Remaining: 30, Reset: reset},
+	}, fakeResponse(http.StatusOK), nil
+}
+
+// call counts the call and returns the context's error, the error set for
+// the method, or a not found error if one of the users does not exist. Must
+// be called with the lock held.
+func (c *FakeClient) call(ctx context.Context, method string, users ...string) (*github.Response, error) {
+	c.calls[method]++
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err, ok := c.errors[method]; ok {
+		return errorResponse(err), err
+	}
+	for _, user := range users {
+		if _, ok := c.users[user]; !ok {
+			resp := fakeResponse(http.StatusNotFound)
+			return resp, &github.ErrorResponse{
+				Response: resp.Response,
+				Message:  fmt.Sprintf("user %q not found", user),
+			}
+		}
+	}
+	return nil, nil
+}
+
+// user returns a user, adding it if needed. Must be called with the lock
+// held.
+func (c *FakeClient) user(login string) *fakeUser {
+	u, ok := c.users[login]
+	if !ok {
+		c.nextID++
+		u = &fakeUser{
+			id:        c.nextID,
+			following: make(map[string]bool),
+		}
+		c.users[login] = u
+	}
+	return u
+}
+
+// page returns a page of users. Must be called with the lock held.
+func (c *FakeClient) page(logins []string, opt *github.ListOptions) ([]*github.User, *github.Response) {
+	start, end, resp := pageBounds(len(logins), opt)
+
+	var users []*github.User
+	for _, login := range logins[start:end] {
+		users = append(users, &github.User{
+			Login: github.String(login),
+			ID:    github.Int64(c.users[login].id),
+		})
+	}
+	return users, resp
+}
+
+// pageBounds returns the slice bounds of a page of n items and a response
+// with the pagination set like GitHub's Link header.
+func pageBounds(n int, opt *github.ListOptions) (int, int, *github.Response) {
+	page, perPage := 1, 30
+	if opt != nil {
+		if opt.Page > 0 {
+			page = opt.Page
+		}
+		if opt.PerPage > 0 {
+			perPage = opt.PerPage
+		}
+	}
+
+	lastPage := (n + perPage - 1) / perPage
+	if lastPage == 0 {
+		lastPage = 1
+	}
+
+	start := (page - 1) * perPage
+	if start > n {
+		start = n
+	}
+	end := start + perPage
+	if end > n {
+		end = n
+	}
+
+	resp := fakeResponse(http.StatusOK)
+	if page < lastPage {
+		resp.NextPage = page + 1
+		resp.LastPage = lastPage
+	}
+	if page > 1 {
+		resp.PrevPage = page - 1
+		resp.FirstPage = 1
+	}
+	return start, end, resp
+}
+
+// errorResponse returns the response of an injected error.
+func errorResponse(err error) *github.Response {
+	var resp *http.Response
+	var respErr *github.ErrorResponse
+	var rateErr *github.RateLimitError
+	var abuseErr *github.AbuseRateLimitError
+	switch {
+	case errors.As(err, &respErr):
+		resp = respErr.Response
+	case errors.As(err, &rateErr):
+		resp = rateErr.Response
+	case errors.As(err, &abuseErr):
+		resp = abuseErr.Response
+	}
+	if resp == nil {
+		return fakeResponse(http.StatusInternalServerError)
+	}
+	return &github.Response{Response: resp}
+}
+
+func fakeResponse(statusCode int) *github.Response {
+	return &github.Response{
+		Response: &http.Response{
+			StatusCode: statusCode,
+			Status:     fmt.Sprintf("%v %s", statusCode, http.StatusText(statusCode)),
+			Header:     make(http.Header),
+			Request: &http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Scheme: "https", Host: "fake.github.invalid"},
+			},
+		},
+	}
+}
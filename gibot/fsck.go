@@ -0,0 +1,576 @@
+package gibot
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// futureTolerance is how far in the future a timestamp may be before it is
+// reported, to allow for clock skew.
+const futureTolerance = time.Minute
+
+// Fsck actions taken on a problem.
+const (
+	FsckRepaired    = "repaired"
+	FsckQuarantined = "quarantined"
+)
+
+// FsckOptions controls what Fsck does with the problems it finds. Broken
+// rows are moved to the quarantine directory with Quarantine, and
+// contradictions are fixed with Repair. Repair implies Quarantine since
+// broken rows cannot be repaired.
+type FsckOptions struct {
+	Repair     bool
+	Quarantine bool
+}
+
+// FsckProblem is a problem found by Fsck. Line is 0 for problems that are
+// not on a single line.
+type FsckProblem struct {
+	File    string
+	Line    int
+	Message string
+	Action  string
+}
+
+func (p *FsckProblem) String() string {
+	location := p.File
+	if p.Line > 0 {
+		location = fmt.Sprintf("%s:%v", p.File, p.Line)
+	}
+	if p.Action != "" {
+		return fmt.Sprintf("%s: %s (%s)", location, p.Message, p.Action)
+	}
+	return fmt.Sprintf("%s: %s", location, p.Message)
+}
+
+// FsckReport is the result of Fsck.
+type FsckReport struct {
+	Files    int
+	Rows     int
+	Problems []*FsckProblem
+}
+
+// Unresolved returns the number of problems that were left as they are.
+func (r *FsckReport) Unresolved() int {
+	var count int
+	for _, problem := range r.Problems {
+		if problem.Action == "" {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *FsckReport) add(file string, line int, message, action string) {
+	r.Problems = append(r.Problems, &FsckProblem{
+		File:    file,
+		Line:    line,
+		Message: message,
+		Action:  action,
+	})
+}
+
+// Checker is implemented by stores that can validate their own data.
+type Checker interface {
+	Fsck(opts *FsckOptions) (*FsckReport, error)
+}
+
+// Fsck validates the bot's store.
+func (b *Bot) Fsck(opts *FsckOptions) (*FsckReport, error) {
+	checker, ok := b.store.(Checker)
+	if !ok {
+		return nil, errors.New("store does not support fsck")
+	}
+	return checker.Fsck(opts)
+}
+
+// targetProblems returns the contradictions in a target and, if repair is
+// set, fixes them.
+func targetProblems(target *Target, now time.Time, repair bool) []string {
+	var problems []string
+
+	if target.Deleted && !target.Followed {
+		problems = append(problems, "deleted=true with followed=false")
+		if repair {
+			target.Followed = true
+		}
+	}
+	if target.UnfollowedDate != nil && !target.Deleted {
+		problems = append(problems, "unfollowed_date set with deleted=false")
+		if repair {
+			target.UnfollowedDate = nil
+		}
+	}
+
+	dates := []struct {
+		name string
+		t    **time.Time
+	}{
+		{"last_activity", &target.LastActivity},
+		{"followed_date", &target.FollowedDate},
+		{"discovered_at", &target.DiscoveredAt},
+		{"followed_back_date", &target.FollowedBackDate},
+		{"unfollowed_date", &target.UnfollowedDate},
+	}
+	for _, date := range dates {
+		if *date.t == nil || !(*date.t).After(now.Add(futureTolerance)) {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%s %s is in the future", date.name, (*date.t).Format(time.RFC3339)))
+		if repair {
+			t := now
+			*date.t = &t
+		}
+	}
+
+	return problems
+}
+
+// csvCheck parses a row and returns it reformatted in the file's columns,
+// the key used to find duplicates and any contradictions. The contradictions
+// are fixed in the returned row if repair is set. An error means the row is
+// broken.
+type csvCheck func(header csvHeader, row []string, now time.Time, repair bool) (record []string, key string, problems []string, err error)
+
+type csvFileSpec struct {
+	file     string
+	columns  []string
+	required []string
+	check    csvCheck
+}
+
+// Fsck validates every file of the store row by row.
+func (s *CSVStore) Fsck(opts *FsckOptions) (*FsckReport, error) {
+	if opts == nil {
+		opts = new(FsckOptions)
+	}
+	report := new(FsckReport)
+	now := time.Now()
+
+	if err := s.fsckSchemaVersion(opts, report); err != nil {
+		return nil, err
+	}
+
+	specs := []*csvFileSpec{
+		{
+			file:     s.targetFile,
+			columns:  targetColumns,
+			required: []string{"username"},
+			check: func(header csvHeader, row []string, now time.Time, repair bool) ([]string, string, []string, error) {
+				target, err := parseTargetRecord(header, row)
+				if err != nil {
+					return nil, "", nil, err
+				}
+				problems := targetProblems(target, now, repair)
+				return targetRecord(target), target.Username, problems, nil
+			},
+		},
+		{
+			file:     s.originalFollowersFile,
+			columns:  baselineColumns,
+			required: baselineColumns,
+			check:    checkBaselineRow,
+		},
+		{
+			file:     s.originalFollowingFile,
+			columns:  baselineColumns,
+			required: baselineColumns,
+			check:    checkBaselineRow,
+		},
+		{
+			file:     s.eventsFile,
+			columns:  eventColumns,
+			required: eventColumns[:3],
+			check: func(header csvHeader, row []string, now time.Time, repair bool) ([]string, string, []string, error) {
+				event, err := parseEventRecord(header, row)
+				if err != nil {
+					return nil, "", nil, err
+				}
+				return eventRecord(event), "", futureProblems("time", &event.Time, now, repair), nil
+			},
+		},
+		{
+			file:     s.journalFile,
+			columns:  journalColumns,
+			required: journalColumns,
+			check: func(header csvHeader, row []string, now time.Time, repair bool) ([]string, string, []string, error) {
+				entry, err := parseJournalRecord(header, row)
+				if err != nil {
+					return nil, "", nil, err
+				}
+				return journalRecord(entry), "", futureProblems("time", &entry.Time, now, repair), nil
+			},
+		},
+		{
+			file:     s.auditFile,
+			columns:  auditColumns,
+			required: auditColumns[:4],
+			check: func(header csvHeader, row []string, now time.Time, repair bool) ([]string, string, []string, error) {
+				entry, err := parseAuditRecord(header, row)
+				if err != nil {
+					return nil, "", nil, err
+				}
+				return auditRecord(entry), "", futureProblems("time", &entry.Time, now, repair), nil
+			},
+		},
+	}
+
+	ids, err := s.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, err := time.Parse(snapshotTimeFormat, id); err != nil {
+			report.add(s.snapshotFile(id), 0, "invalid snapshot id", "")
+		}
+		specs = append(specs, &csvFileSpec{
+			file:     s.snapshotFile(id),
+			columns:  snapshotColumns,
+			required: snapshotColumns,
+			check: func(header csvHeader, row []string, now time.Time, repair bool) ([]string, string, []string, error) {
+				kind, username, err := parseSnapshotRecord(header, row)
+				if err != nil {
+					return nil, "", nil, err
+				}
+				return []string{string(kind), username}, string(kind) + "/" + username, nil, nil
+			},
+		})
+	}
+
+	for _, spec := range specs {
+		if err := s.fsckFile(spec, opts, now, report); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// fsckSchemaVersion reports an unreadable schema_version file and, if
+// repair is set, resets it to version 0. The migrations only add the
+// columns missing from targets.csv, so the next start upgrades the store
+// from any version.
+func (s *CSVStore) fsckSchemaVersion(opts *FsckOptions, report *FsckReport) error {
+	data, err := ioutil.ReadFile(s.schemaFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	report.Files++
+	if _, err := parseSchemaVersion(data); err != nil {
+		action := ""
+		if opts.Repair {
+			if err := s.setSchemaVersion(0); err != nil {
+				return err
+			}
+			action = FsckRepaired
+		}
+		report.add(s.schemaFile, 1, err.Error(), action)
+	}
+	return nil
+}
+
+func checkBaselineRow(header csvHeader, row []string, now time.Time, repair bool) ([]string, string, []string, error) {
+	username, err := parseBaselineRecord(header, row)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return []string{username}, username, nil, nil
+}
+
+// futureProblems reports a timestamp in the future and, if repair is set,
+// sets it to now.
+func futureProblems(name string, t *time.Time, now time.Time, repair bool) []string {
+	if !t.After(now.Add(futureTolerance)) {
+		return nil
+	}
+	problem := fmt.Sprintf("%s %s is in the future", name, t.Format(time.RFC3339))
+	if repair {
+		*t = now
+	}
+	return []string{problem}
+}
+
+func (s *CSVStore) fsckFile(spec *csvFileSpec, opts *FsckOptions, now time.Time, report *FsckReport) error {
+	f, err := os.Open(spec.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	report.Files++
+	quarantine := opts.Quarantine || opts.Repair
+	repairAction := ""
+	if opts.Repair {
+		repairAction = FsckRepaired
+	}
+	quarantineAction := ""
+	if quarantine {
+		quarantineAction = FsckQuarantined
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+
+	headerRow, err := r.Read()
+	if err == io.EOF {
+		report.add(spec.file, 0, "empty file without header", repairAction)
+		if opts.Repair {
+			return writeCSV(spec.file, [][]string{spec.columns})
+		}
+		return nil
+	}
+	if err != nil {
+		report.add(spec.file, 1, fmt.Sprintf("unreadable header: %v", err), "")
+		return nil
+	}
+	header := newCSVHeader(headerRow)
+	for _, column := range spec.required {
+		if !header.has(column) {
+			report.add(spec.file, 1, fmt.Sprintf("missing %s column", column), "")
+			return nil
+		}
+	}
+
+	// raw rows are written back with only the broken ones taken out, repaired
+	// records replace the whole file
+	var raw, records [][]string
+	var quarantined [][]string
+	changed := false
+	keys := make(map[string]int)
+	lines := make(map[int]int)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		report.Rows++
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			report.add(spec.file, parseErr.StartLine, parseErr.Err.Error(), quarantineAction)
+			quarantined = append(quarantined, []string{strconv.Itoa(parseErr.StartLine), parseErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := r.FieldPos(0)
+
+		record, key, problems, err := spec.check(header, row, now, opts.Repair)
+		if err != nil {
+			report.add(spec.file, line, err.Error(), quarantineAction)
+			quarantined = append(quarantined, append([]string{strconv.Itoa(line), err.Error()}, row...))
+			continue
+		}
+		for _, problem := range problems {
+			report.add(spec.file, line, problem, repairAction)
+			changed = true
+		}
+		if len(row) != len(headerRow) {
+			report.add(spec.file, line, fmt.Sprintf("row has %v fields, header has %v", len(row), len(headerRow)), repairAction)
+			changed = true
+		}
+
+		if key != "" {
+			if i, ok := keys[key]; ok {
+				report.add(spec.file, line, fmt.Sprintf("duplicate of line %v", lines[i]), repairAction)
+				changed = true
+				records[i] = nil
+			}
+			keys[key] = len(records)
+		}
+		lines[len(records)] = line
+		raw = append(raw, row)
+		records = append(records, record)
+	}
+
+	switch {
+	case opts.Repair && (changed || len(quarantined) > 0):
+		rows := [][]string{spec.columns}
+		for _, record := range records {
+			if record != nil {
+				rows = append(rows, record)
+			}
+		}
+		if err := writeCSV(spec.file, rows); err != nil {
+			return err
+		}
+	case quarantine && len(quarantined) > 0:
+		if err := writeCSV(spec.file, append([][]string{headerRow}, raw...)); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	if len(quarantined) > 0 {
+		return s.quarantineRows(spec.file, quarantined)
+	}
+	return nil
+}
+
+// quarantineRows appends broken rows, prefixed with their line number and
+// problem, to a file of the same name in the quarantine directory.
+func (s *CSVStore) quarantineRows(file string, rows [][]string) error {
+	dir := filepath.Join(s.dir, "quarantine")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(s.dir, file)
+	if err != nil {
+		rel = filepath.Base(file)
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%v-%s", time.Now().Unix(), filepath.ToSlash(rel)))
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if err := appendCSV(name, []string{"line", "problem", "row"}, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fsck checks that every record decodes and the targets are consistent.
+// Records that do not decode are moved to the quarantine bucket. Partial
+// transactions are already discarded when the database is opened.
+func (s *DBStore) Fsck(opts *FsckOptions) (*FsckReport, error) {
+	if opts == nil {
+		opts = new(FsckOptions)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := &FsckReport{
+		Files: 1,
+	}
+	now := time.Now()
+	quarantine := opts.Quarantine || opts.Repair
+
+	if s.damage != nil {
+		if err := s.fsckDamage(quarantine, now, report); err != nil {
+			return nil, err
+		}
+	}
+
+	decoders := map[string]func() interface{}{
+		bucketTargets:   func() interface{} { return new(Target) },
+		bucketBaselines: func() interface{} { return new([]string) },
+		bucketEvents:    func() interface{} { return new(Event) },
+		bucketJournal:   func() interface{} { return new(JournalEntry) },
+		bucketAudit:     func() interface{} { return new(AuditEntry) },
+		bucketSnapshots: func() interface{} { return new(Snapshot) },
+	}
+
+	var ops []dbOp
+	for _, name := range sortedBucketNames(decoders) {
+		bucket := s.buckets[name]
+		for _, key := range sortedKeys(bucket) {
+			report.Rows++
+			location := name + "/" + key
+
+			value := decoders[name]()
+			if err := json.Unmarshal(bucket[key], value); err != nil {
+				action := ""
+				if quarantine {
+					action = FsckQuarantined
+					ops = append(ops,
+						dbOp{Bucket: bucketQuarantine, Key: location, Value: bucket[key]},
+						dbOp{Delete: true, Bucket: name, Key: key},
+					)
+				}
+				report.add(location, 0, err.Error(), action)
+				continue
+			}
+
+			target, ok := value.(*Target)
+			if !ok {
+				continue
+			}
+			problems := targetProblems(target, now, opts.Repair)
+			action := ""
+			if opts.Repair && len(problems) > 0 {
+				action = FsckRepaired
+				encoded, err := json.Marshal(target)
+				if err != nil {
+					return nil, err
+				}
+				ops = append(ops, dbOp{Bucket: name, Key: key, Value: encoded})
+			}
+			for _, problem := range problems {
+				report.add(location, 0, problem, action)
+			}
+		}
+	}
+
+	if err := s.commit(ops); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// fsckDamage reports the damaged transaction and, if quarantine is set,
+// moves it and everything after it to a file next to the database, so the
+// transactions before it can be used again.
+func (s *DBStore) fsckDamage(quarantine bool, now time.Time, report *FsckReport) error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("transaction at offset %v cannot be read: %v, %v bytes from there are lost", s.damage.offset, s.damage.err, info.Size()-s.damage.offset)
+	if !quarantine {
+		report.add(s.path, 0, message, "")
+		return nil
+	}
+
+	tail := make([]byte, info.Size()-s.damage.offset)
+	if _, err := s.file.ReadAt(tail, s.damage.offset); err != nil {
+		return err
+	}
+	damaged := fmt.Sprintf("%s.damaged-%v", s.path, now.Unix())
+	err = writeFileAtomic(damaged, func(w io.Writer) error {
+		_, err := w.Write(tail)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.file.Truncate(s.damage.offset); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	report.add(s.path, 0, fmt.Sprintf("%s, moved to %s", message, damaged), FsckQuarantined)
+	s.damage = nil
+	return nil
+}
+
+func sortedBucketNames(decoders map[string]func() interface{}) []string {
+	var names []string
+	for name := range decoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,149 @@
+package gibot
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fsckStore checks the store at path the way the fsck command does, and
+// returns the report.
+func fsckStore(t *testing.T, path string, opts *FsckOptions) *FsckReport {
+	t.Helper()
+	bot, err := NewBot(&Config{
+		Username:  "bob",
+		StorePath: path,
+		CheckOnly: true,
+		Client:    NewFakeClient("bob"),
+	})
+	if err != nil {
+		t.Fatalf("open for fsck: %v", err)
+	}
+	defer bot.Close()
+
+	report, err := bot.Fsck(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// openBot opens the store at path the way the other commands do.
+func openBot(path string) error {
+	bot, err := NewBot(&Config{
+		Username:  "bob",
+		StorePath: path,
+		Client:    NewFakeClient("bob"),
+	})
+	if err != nil {
+		return err
+	}
+	return bot.Close()
+}
+
+func TestFsckUnmigratedCSVStore(t *testing.T) {
+	dir := t.TempDir()
+	// A version 0 store with a stray quote, which the migration cannot read.
+	data := "username,followed\nalice,true\nbo\"b,false\n"
+	if err := os.WriteFile(filepath.Join(dir, "targets.csv"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := openBot(dir); err == nil {
+		t.Fatal("damaged store was migrated")
+	}
+
+	report := fsckStore(t, dir, nil)
+	if report.Unresolved() == 0 {
+		t.Fatal("stray quote not reported")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "schema_version")); !os.IsNotExist(err) {
+		t.Error("fsck migrated the store")
+	}
+
+	if report := fsckStore(t, dir, &FsckOptions{Quarantine: true}); report.Unresolved() != 0 {
+		t.Fatalf("unresolved problems after quarantine: %v", report.Problems)
+	}
+	if err := openBot(dir); err != nil {
+		t.Fatalf("open after fsck: %v", err)
+	}
+}
+
+func TestFsckInvalidSchemaVersion(t *testing.T) {
+	dir := t.TempDir()
+	store := NewCSVStore(dir)
+	if err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveTargets([]*Target{{Username: "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "schema_version"), []byte("two\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := openBot(dir); err == nil {
+		t.Fatal("store with an invalid schema version was opened")
+	}
+
+	if report := fsckStore(t, dir, nil); report.Unresolved() != 1 {
+		t.Fatalf("problems = %v, want the schema version", report.Problems)
+	}
+	if report := fsckStore(t, dir, &FsckOptions{Repair: true}); report.Unresolved() != 0 {
+		t.Fatalf("unresolved problems after repair: %v", report.Problems)
+	}
+	if err := openBot(dir); err != nil {
+		t.Fatalf("open after fsck: %v", err)
+	}
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Username != "alice" {
+		t.Errorf("targets after repair = %v", targetNames(targets))
+	}
+}
+
+func TestFsckDamagedDBStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gibot.db")
+	store := openTestDB(t, path)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if err := store.UpdateTarget(&Target{Username: username}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[strings.Index(string(data), "bob")] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report := fsckStore(t, path, nil)
+	if report.Unresolved() != 1 {
+		t.Fatalf("problems = %v, want the damaged transaction", report.Problems)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(data) {
+		t.Error("fsck without -quarantine modified the database")
+	}
+
+	if report := fsckStore(t, path, &FsckOptions{Quarantine: true}); report.Unresolved() != 0 {
+		t.Fatalf("unresolved problems after quarantine: %v", report.Problems)
+	}
+	damaged, err := filepath.Glob(path + ".damaged-*")
+	if err != nil || len(damaged) != 1 {
+		t.Fatalf("damaged transactions not kept: %v, %v", damaged, err)
+	}
+
+	store = openTestDB(t, path)
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := targetNames(targets); len(got) != 1 || got[0] != "alice" {
+		t.Errorf("targets after quarantine = %v, want [alice]", got)
+	}
+}
@@ -2,18 +2,17 @@ package gibot
 
 import (
 	"context"
-	"encoding/csv"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"net/http"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"runtime"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/google/go-github/github"
@@ -22,67 +21,360 @@ import (
 )
 
 // Target ...
-type target struct {
-	username     string
-	lastActivity *time.Time
-	followed     bool
-	followedDate *time.Time
-	deleted      bool
+type Target struct {
+	Username string `json:"username"`
+	UserID   int64  `json:"user_id,omitempty"`
+
+	// Source is how the target was discovered, e.g. "search", and Query the
+	// search query that found it.
+	Source       string     `json:"source,omitempty"`
+	Query        string     `json:"query,omitempty"`
+	DiscoveredAt *time.Time `json:"discovered_at,omitempty"`
+
+	// RecentEvents is the number of events in the activity window and Score
+	// weighs them by how recent they are.
+	LastActivity *time.Time `json:"last_activity,omitempty"`
+	RecentEvents int        `json:"recent_events,omitempty"`
+	Score        float64    `json:"score,omitempty"`
+
+	Followed         bool       `json:"followed"`
+	FollowedDate     *time.Time `json:"followed_date,omitempty"`
+	FollowedBackDate *time.Time `json:"followed_back_date,omitempty"`
+	Deleted          bool       `json:"deleted"`
+	UnfollowedDate   *time.Time `json:"unfollowed_date,omitempty"`
+
+	// Attempts counts the follow and unfollow calls made for the target and
+	// LastError is the error of the last failed one.
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// SourceSearch is the source of targets found by searching users.
+const SourceSearch = "search"
+
+// maxSearchPages is the number of pages of search results checked per
+// query.
+const maxSearchPages = 4
+
+// activityWindow is how far back events count as recent activity.
+const activityWindow = 48 * time.Hour
+
+// activityEvents is the number of latest events a user's activity is scored
+// on, one page of them.
+const activityEvents = 2
+
+// activity summarizes the recent events of a user.
+type activity struct {
+	Active       bool
+	LastActivity *time.Time
+	RecentEvents int
+	Score        float64
 }
 
 // Bot ...
 type Bot struct {
-	client                *github.Client
-	username              string
-	targets               map[string]*target
-	targetFile            string
-	originalFollowers     map[string]bool
-	originalFollowersFile string
-	originalFollowing     map[string]bool
-	originalFollowingFile string
+	client            Client
+	username          string
+	store             Store
+	targets           map[string]*Target
+	originalFollowers map[string]bool
+	originalFollowing map[string]bool
+	snapshotRetention SnapshotRetention
+	snapshot          *Snapshot
+	runID             string
+	limiter           *rateLimiter
+	breaker           *circuitBreaker
+	retryPolicy       RetryPolicy
+	requestTimeout    time.Duration
+	cache             *cacheTransport
+	metrics           *metricsTransport
+	cassette          *cassetteTransport
+	clock             clock
+	graphQL           bool
+	enterprise        bool
+	app               bool
+	readOnly          bool
+	lock              *storeLock
+	// ownsStore is set when the bot opened the store, and so closes it.
+	ownsStore bool
+	mu        sync.Mutex
 }
 
 // Config ...
 type Config struct {
 	AccessToken string
-	Username    string
-	StorePath   string
+	// TokenSource supplies the tokens instead of AccessToken, see
+	// NewFileTokenSource and NewCommandTokenSource.
+	TokenSource oauth2.TokenSource
+	// App authenticates as a GitHub App installation instead. Its tokens
+	// cannot follow users, so the bot is read-only.
+	App      *AppCredentials
+	Username string
+	// ReadOnly refuses follows and unfollows.
+	ReadOnly bool
+	// StorePath is the directory of the CSV store, or the database file if it
+	// ends in ".db".
+	StorePath string
+	// Store overrides the store in StorePath.
+	Store Store
+	// CheckOnly opens the store in StorePath as it is, for Fsck: the schema
+	// is not upgraded, CSV files are not migrated to a database and a
+	// damaged database is loaded up to the damage.
+	CheckOnly bool
+	// SnapshotRetention controls how many follower and following snapshots
+	// are kept.
+	SnapshotRetention SnapshotRetention
+	// LockWait is how long to wait for another bot using the same store to
+	// finish. By default NewBot fails right away.
+	LockWait time.Duration
+	// RequestTimeout limits each API call. Zero means DefaultRequestTimeout
+	// and a negative timeout disables it.
+	RequestTimeout time.Duration
+	// Retry controls how API calls failing with transient errors are
+	// retried.
+	Retry RetryPolicy
+	// Client overrides the GitHub REST client built from AccessToken, e.g.
+	// with a FakeClient.
+	Client Client
+	// BaseURL is the API URL of a GitHub Enterprise Server, e.g.
+	// https://github.example.com/api/v3/. By default gibot uses GitHub.com.
+	BaseURL string
+	// UploadURL is the upload URL of a GitHub Enterprise Server. It defaults
+	// to the server's /api/uploads/.
+	UploadURL string
+	// CABundle is a PEM file of certificates to trust, e.g. the internal CA
+	// of a GitHub Enterprise Server.
+	CABundle string
+	// GraphQL fetches the profiles of search results in batches with the
+	// GraphQL API, if the client supports it, to skip the activity checks
+	// of users that no longer exist or are already followed. Activity is
+	// still checked with the REST API.
+	GraphQL bool
+	// CacheDir is the directory of the response cache. By default it is the
+	// cache directory next to the store in StorePath, and there is no cache
+	// if Store is set.
+	CacheDir string
+	// DisableCache turns the response cache off.
+	DisableCache bool
+	// Trace logs every API request and response at the debug level, with
+	// the credentials redacted.
+	Trace bool
+	// Cassette records the API exchanges to a cassette, or replays a
+	// recorded run from it. The response cache is off in both modes.
+	// Recording saves the store next to the cassette, and replays run on a
+	// copy of it in memory.
+	Cassette CassetteMode
+	// CassettePath is the cassette file. By default it is in the store
+	// directory.
+	CassettePath string
 }
 
 // NewBot ...
-func NewBot(config *Config) *Bot {
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{
-			AccessToken: config.AccessToken,
-		},
-	)
-	tc := oauth2.NewClient(context.Background(), ts)
-	client := github.NewClient(tc)
-
-	configPath := NormalizePath(config.StorePath)
+func NewBot(config *Config) (*Bot, error) {
+	path := NormalizePath(config.StorePath)
+
+	var lock *storeLock
+	store := config.Store
+	switch {
+	case store != nil:
+	case config.Cassette == CassetteReplay:
+		// Replays start from the store as it was recorded and keep their
+		// changes in memory, leaving the store in StorePath alone.
+		var err error
+		store, err = loadCassetteState(cassettePath(config, path))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		var err error
+		lock, err = lockStore(path, config.LockWait)
+		if err != nil {
+			return nil, err
+		}
+		store, err = openStore(path, config.CheckOnly)
+		if err != nil {
+			lock.release()
+			return nil, err
+		}
+	}
+	closeStore := func() {
+		if config.Store != nil {
+			return
+		}
+		if closer, ok := store.(io.Closer); ok {
+			closer.Close()
+		}
+		lock.release()
+	}
 
-	if configPath == "" {
-		configPath = "./"
+	// The client is made once the store is locked, since recording
+	// overwrites the cassette in the store directory.
+	layers := new(transports)
+	client := config.Client
+	if client == nil {
+		var err error
+		client, layers, err = newGitHubClient(config, path)
+		if err != nil {
+			closeStore()
+			return nil, err
+		}
+	}
+	if config.Cassette == CassetteRecord {
+		if err := saveCassetteState(cassettePath(config, path), store); err != nil {
+			layers.cassette.Close()
+			closeStore()
+			return nil, err
+		}
 	}
 
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		log.Printf("creating config directory %s", configPath)
-		os.MkdirAll(configPath, os.ModePerm)
+	var clk clock = systemClock{}
+	if layers.cassette != nil && layers.cassette.clock != nil {
+		clk = layers.cassette.clock
 	}
 
-	targetFile := fmt.Sprintf("%s/targets.csv", configPath)
-	followersFile := fmt.Sprintf("%s/original_followers.csv", configPath)
-	followingFile := fmt.Sprintf("%s/original_following.csv", configPath)
 	return &Bot{
-		client:                client,
-		username:              config.Username,
-		targets:               make(map[string]*target),
-		targetFile:            targetFile,
-		originalFollowers:     make(map[string]bool),
-		originalFollowersFile: followersFile,
-		originalFollowing:     make(map[string]bool),
-		originalFollowingFile: followingFile,
+		client:            client,
+		lock:              lock,
+		username:          config.Username,
+		store:             store,
+		targets:           make(map[string]*Target),
+		originalFollowers: make(map[string]bool),
+		originalFollowing: make(map[string]bool),
+		snapshotRetention: config.SnapshotRetention,
+		runID:             newRunID(clk.Now()),
+		limiter:           newRateLimiter(clk),
+		breaker:           &circuitBreaker{clock: clk},
+		retryPolicy:       config.Retry,
+		requestTimeout:    config.RequestTimeout,
+		cache:             layers.cache,
+		metrics:           layers.metrics,
+		cassette:          layers.cassette,
+		clock:             clk,
+		graphQL:           config.GraphQL,
+		enterprise:        config.BaseURL != "",
+		app:               config.App != nil,
+		readOnly:          config.ReadOnly || config.App != nil,
+		ownsStore:         config.Store == nil,
+	}, nil
+}
+
+// Close closes the cassette and the store the bot opened, not one given in
+// Config.Store, and releases the store lock. Closing it again does nothing.
+func (b *Bot) Close() error {
+	err := b.cassette.Close()
+	if closer, ok := b.store.(io.Closer); ok && b.ownsStore {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+		b.ownsStore = false
+	}
+	if closeErr := b.lock.release(); err == nil {
+		err = closeErr
 	}
+	return err
+}
+
+// ReadOnly reports whether the bot refuses follows and unfollows.
+func (b *Bot) ReadOnly() bool {
+	return b.readOnly
+}
+
+// Targets returns the stored targets in a state, sorted by username.
+func (b *Bot) Targets(state TargetState) ([]*Target, error) {
+	if index, ok := b.store.(TargetIndex); ok {
+		return index.TargetsByState(state)
+	}
+
+	targets, err := b.store.LoadTargets()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Target
+	for _, target := range targets {
+		if target.State() == state {
+			result = append(result, target)
+		}
+	}
+	sortTargets(result)
+	return result, nil
+}
+
+// CacheStats returns the response cache hits and misses of this bot.
+func (b *Bot) CacheStats() CacheStats {
+	return b.cache.stats()
+}
+
+// storeDir returns the directory of the store at path.
+func storeDir(path string) string {
+	if filepath.Ext(path) == ".db" {
+		return filepath.Dir(path)
+	}
+	if path == "" {
+		return "./"
+	}
+	return path
+}
+
+// lockStore locks the directory of the store at path. CSV and database
+// stores in the same directory share the lock, as a database store is seeded
+// from the CSV files next to it.
+func lockStore(path string, wait time.Duration) (*storeLock, error) {
+	dir := storeDir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return acquireLock(filepath.Join(dir, "gibot.lock"), wait)
+}
+
+// openStore opens the database store if path is a ".db" file and the CSV
+// store otherwise. A new database store is seeded from the CSV files found
+// next to it.
+func openStore(path string, check bool) (Store, error) {
+	if filepath.Ext(path) != ".db" {
+		if path == "" {
+			path = "./"
+		}
+
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			log.Printf("creating config directory %s", path)
+			if err := os.MkdirAll(path, os.ModePerm); err != nil {
+				return nil, err
+			}
+		}
+
+		store := NewCSVStore(path)
+		if check {
+			return store, nil
+		}
+		if err := store.Migrate(); err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	store, err := openDBStore(path, check)
+	if err != nil {
+		return nil, err
+	}
+	if check {
+		return store, nil
+	}
+
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(filepath.Join(dir, "targets.csv")); err == nil && store.empty() && !store.migrated() {
+		log.Printf("migrating csv store %s to %s", dir, path)
+		src := NewCSVStore(dir)
+		if err := src.Migrate(); err != nil {
+			store.Close()
+			return nil, err
+		}
+		if err := store.migrateFrom(src); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	return store, nil
 }
 
 // StartConfig ...
@@ -93,24 +385,42 @@ type StartConfig struct {
 	Unfollow bool
 }
 
-// Start ...
-func (b *Bot) Start(config *StartConfig) error {
-	go b.handleExitSignal()
-
+// Start runs the phases in config. When ctx is canceled the running phase
+// stops and the targets are saved.
+func (b *Bot) Start(ctx context.Context, config *StartConfig) error {
+	if b.readOnly && (config.Follow || config.Unfollow) {
+		return ErrReadOnly
+	}
+	if err := b.preflight(withPhase(ctx, PhasePreflight), config.Follow || config.Unfollow); err != nil {
+		return err
+	}
+	defer b.logSummary()
+	if b.cache != nil {
+		defer func() {
+			stats := b.CacheStats()
+			log.Printf("response cache: %v hits, %v misses\n", stats.Hits, stats.Misses)
+		}()
+	}
 	search := config.Search
 	queries := config.Queries
 	followTargets := config.Follow
 	unfollowTargets := config.Unfollow
 
-	err := b.loadState()
+	snapshot, err := b.takeSnapshot(withPhase(ctx, PhaseSnapshot))
+	if err != nil {
+		return err
+	}
+	b.snapshot = snapshot
+
+	err = b.loadState(withPhase(ctx, PhaseState))
 	if err != nil {
 		return err
 	}
 
 	if search {
-		err := b.searchActiveUsers(queries)
+		err := b.searchActiveUsers(ctx, queries)
 		if err != nil {
-			return err
+			return b.halt(err)
 		}
 		if err := b.saveTargets(); err != nil {
 			return err
@@ -118,8 +428,8 @@ func (b *Bot) Start(config *StartConfig) error {
 	}
 
 	if followTargets {
-		if err := b.followTargets(); err != nil {
-			return err
+		if err := b.followTargets(withPhase(ctx, PhaseFollow)); err != nil {
+			return b.halt(err)
 		}
 		if err := b.saveTargets(); err != nil {
 			return err
@@ -127,8 +437,8 @@ func (b *Bot) Start(config *StartConfig) error {
 	}
 
 	if unfollowTargets {
-		if err := b.unfollowTargets(); err != nil {
-			return err
+		if err := b.unfollowTargets(withPhase(ctx, PhaseUnfollow)); err != nil {
+			return b.halt(err)
 		}
 		if err := b.saveTargets(); err != nil {
 			return err
@@ -138,161 +448,180 @@ func (b *Bot) Start(config *StartConfig) error {
 	return nil
 }
 
-func (b *Bot) loadState() error {
-	if _, err := os.Stat(b.originalFollowersFile); !os.IsNotExist(err) {
-		f, err := os.Open(b.originalFollowersFile)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		lines, err := csv.NewReader(f).ReadAll()
-		if err != nil {
-			return err
-		}
-
-		for _, line := range lines[1:] {
-			b.originalFollowers[line[0]] = true
-		}
-	} else {
-		followers, err := b.getFollowers(b.username)
-		if err != nil {
-			return err
-		}
-		if err := b.saveFollowers(followers); err != nil {
-			return err
-		}
-		for _, follower := range followers {
-			b.originalFollowers[follower.GetLogin()] = true
-		}
+// halt saves the targets after a phase of Start failed or was interrupted,
+// and returns err.
+func (b *Bot) halt(err error) error {
+	var limitErr *SecondaryLimitError
+	switch {
+	case errors.As(err, &limitErr):
+		log.Errorf("halting run: %v", err)
+		b.recordPause(limitErr)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		log.Println("interrupted, saving latest state")
 	}
 
-	if _, err := os.Stat(b.originalFollowingFile); !os.IsNotExist(err) {
-		f, err := os.Open(b.originalFollowingFile)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		lines, err := csv.NewReader(f).ReadAll()
-		if err != nil {
-			return err
-		}
+	if err := b.saveTargets(); err != nil {
+		log.Errorf("save targets error: %v", err)
+	}
+	return err
+}
 
-		for _, line := range lines[1:] {
-			b.originalFollowing[line[0]] = true
-		}
-	} else {
-		following, err := b.getFollowing(b.username)
+func (b *Bot) loadState(ctx context.Context) error {
+	followers, found, err := b.store.LoadBaseline(BaselineFollowers)
+	if err != nil {
+		return fmt.Errorf("%v (run the fsck command to check the store)", err)
+	}
+	if !found {
+		followers, err = b.currentFollowers(ctx)
 		if err != nil {
 			return err
 		}
-		if err := b.saveFollowing(following); err != nil {
+		if err := b.store.SaveBaseline(BaselineFollowers, followers); err != nil {
 			return err
 		}
-		for _, follower := range following {
-			b.originalFollowing[follower.GetLogin()] = true
-		}
+	}
+	for _, follower := range followers {
+		b.originalFollowers[follower] = true
 	}
 
-	if _, err := os.Stat(b.targetFile); !os.IsNotExist(err) {
-		f, err := os.Open(b.targetFile)
+	following, found, err := b.store.LoadBaseline(BaselineFollowing)
+	if err != nil {
+		return fmt.Errorf("%v (run the fsck command to check the store)", err)
+	}
+	if !found {
+		following, err = b.currentFollowing(ctx)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-
-		lines, err := csv.NewReader(f).ReadAll()
-		if err != nil {
+		if err := b.store.SaveBaseline(BaselineFollowing, following); err != nil {
 			return err
 		}
+	}
+	for _, follower := range following {
+		b.originalFollowing[follower] = true
+	}
 
-		for _, line := range lines[1:] {
-			username := line[0]
-			lastActivityStr := line[1]
-			followedStr := line[2]
-			followedDateStr := line[3]
-			var lastActivity *time.Time
-			var followedDate *time.Time
-
-			followed, err := strconv.ParseBool(followedStr)
-			if err != nil {
-				return err
-			}
+	targets, err := b.store.LoadTargets()
+	if err != nil {
+		return fmt.Errorf("%v (run the fsck command to check the store)", err)
+	}
+	for _, target := range targets {
+		b.targets[target.Username] = target
+	}
 
-			var deleted bool
-			if len(line) > 4 {
-				deleted, err = strconv.ParseBool(line[4])
-				if err != nil {
-					return err
-				}
-			}
+	if err := b.replayJournal(ctx); err != nil {
+		return err
+	}
 
-			if lastActivityStr != "" {
-				i, err := strconv.ParseInt(lastActivityStr, 10, 64)
-				if err != nil {
-					return err
-				}
-				t := time.Unix(i, 0)
-				lastActivity = &t
-			}
+	if b.updateFollowBacks() > 0 {
+		return b.saveTargets()
+	}
+	return nil
+}
 
-			if followedDateStr != "" {
-				i, err := strconv.ParseInt(followedDateStr, 10, 64)
-				if err != nil {
-					return err
-				}
-				t := time.Unix(i, 0)
-				followedDate = &t
-			}
+// currentFollowers returns the followers from this run's snapshot, fetching
+// them if no snapshot was taken.
+func (b *Bot) currentFollowers(ctx context.Context) ([]string, error) {
+	if b.snapshot != nil {
+		return b.snapshot.Followers, nil
+	}
+	users, err := b.getFollowers(ctx, b.username)
+	if err != nil {
+		return nil, err
+	}
+	return usernames(users), nil
+}
 
-			b.targets[username] = &target{
-				username:     username,
-				lastActivity: lastActivity,
-				followed:     followed,
-				followedDate: followedDate,
-				deleted:      deleted,
-			}
-		}
+// currentFollowing returns the following from this run's snapshot, fetching
+// them if no snapshot was taken.
+func (b *Bot) currentFollowing(ctx context.Context) ([]string, error) {
+	if b.snapshot != nil {
+		return b.snapshot.Following, nil
 	}
-	return nil
+	users, err := b.getFollowing(ctx, b.username)
+	if err != nil {
+		return nil, err
+	}
+	return usernames(users), nil
 }
 
-func (b *Bot) followTargets() error {
+func (b *Bot) followTargets(ctx context.Context) error {
 	log.Println("starting following of targets")
 	for _, target := range b.targets {
-		if target.followed {
+		if target.Followed {
 			continue
 		}
-		if err := b.follow(target.username); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		target.Attempts++
+		err := b.journaled(JournalFollow, target.Username, func() error {
+			return b.follow(ctx, target.Username)
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			log.Errorf("follow target error: %v", err)
+			target.LastError = err.Error()
+			b.saveTarget(target)
+			if isSecondaryLimitError(err) {
+				return err
+			}
 			continue
 		}
-		log.Printf("followed target user %q\n", target.username)
-		b.targets[target.username].followed = true
-		t := time.Now()
-		b.targets[target.username].followedDate = &t
-		longWait()
+		log.Printf("followed target user %q\n", target.Username)
+		t := b.clock.Now()
+		target.Followed = true
+		target.FollowedDate = &t
+		target.LastError = ""
+		b.saveTarget(target)
+		b.recordEvent(EventFollowed, target.Username)
+		if err := b.longWait(ctx); err != nil {
+			return err
+		}
 	}
 
 	log.Println("done following all targets")
 	return nil
 }
 
-func (b *Bot) unfollowTargets() error {
+func (b *Bot) unfollowTargets(ctx context.Context) error {
 	log.Println("starting unfollowing all targets")
 	for _, target := range b.targets {
-		_, ok := b.originalFollowing[target.username]
-		if ok || target.deleted || !target.followed {
+		_, ok := b.originalFollowing[target.Username]
+		if ok || target.Deleted || !target.Followed {
 			continue
 		}
-		if err := b.Unfollow(target.username); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		target.Attempts++
+		err := b.journaled(JournalUnfollow, target.Username, func() error {
+			return b.Unfollow(ctx, target.Username)
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			log.Errorf("unfollow target error: %v", err)
+			target.LastError = err.Error()
+			b.saveTarget(target)
+			if isSecondaryLimitError(err) {
+				return err
+			}
 			continue
 		}
-		log.Printf("unfollowed target %q\n", target.username)
-		b.targets[target.username].deleted = true
-		b.ThrottleWait()
+		log.Printf("unfollowed target %q\n", target.Username)
+		t := b.clock.Now()
+		target.Deleted = true
+		target.UnfollowedDate = &t
+		target.LastError = ""
+		b.saveTarget(target)
+		b.recordEvent(EventUnfollowed, target.Username)
+		if err := b.ThrottleWait(ctx); err != nil {
+			return err
+		}
 	}
 
 	log.Println("done unfollowing all followed targets")
@@ -300,42 +629,10 @@ func (b *Bot) unfollowTargets() error {
 }
 
 func (b *Bot) saveTargets() error {
-	records := [][]string{
-		[]string{"username", "last_activity", "followed", "followed_date", "deleted"},
-	}
-	for _, target := range b.targets {
-		var lastActivity int64
-		if target.lastActivity != nil {
-			lastActivity = target.lastActivity.Unix()
-		}
-		var followedDate int64
-		if target.followedDate != nil {
-			followedDate = target.followedDate.Unix()
-		}
-		records = append(records, []string{
-			target.username,
-			fmt.Sprintf("%v", lastActivity),
-			fmt.Sprintf("%v", target.followed),
-			fmt.Sprintf("%v", followedDate),
-			fmt.Sprintf("%v", target.deleted),
-		})
-	}
-
-	fo, err := os.Create(b.targetFile)
-	if err != nil {
+	if err := b.store.SaveTargets(b.targetList()); err != nil {
 		return err
 	}
-	w := csv.NewWriter(fo)
-
-	for _, record := range records {
-		if err := w.Write(record); err != nil {
-			log.Fatalln("error writing record to csv:", err)
-		}
-	}
-
-	w.Flush()
-
-	if err := w.Error(); err != nil {
+	if err := b.clearJournal(); err != nil {
 		return err
 	}
 
@@ -343,150 +640,130 @@ func (b *Bot) saveTargets() error {
 	return nil
 }
 
-func (b *Bot) saveFollowing(following []*github.User) error {
-	records := [][]string{
-		[]string{"username"},
-	}
-	for _, follower := range following {
-		records = append(records, []string{
-			follower.GetLogin(),
-		})
-	}
-
-	fo, err := os.Create(b.originalFollowingFile)
-	if err != nil {
-		return err
-	}
-	w := csv.NewWriter(fo)
-
-	for _, record := range records {
-		if err := w.Write(record); err != nil {
-			log.Fatalln("error writing record to csv:", err)
-		}
-	}
-
-	w.Flush()
-
-	if err := w.Error(); err != nil {
-		return err
+// targetList returns the targets of the bot.
+func (b *Bot) targetList() []*Target {
+	var targets []*Target
+	for _, target := range b.targets {
+		targets = append(targets, target)
 	}
-
-	return nil
+	return targets
 }
 
-func (b *Bot) saveFollowers(followers []*github.User) error {
-	records := [][]string{
-		[]string{"username"},
+// saveTarget persists a single target right away when the store supports it;
+// otherwise it is written with the rest by saveTargets.
+func (b *Bot) saveTarget(target *Target) {
+	updater, ok := b.store.(TargetUpdater)
+	if !ok {
+		return
 	}
-	for _, follower := range followers {
-		records = append(records, []string{
-			follower.GetLogin(),
-		})
+	if err := updater.UpdateTarget(target); err != nil {
+		log.Errorf("save target error: %v", err)
 	}
+}
 
-	fo, err := os.Create(b.originalFollowersFile)
+func (b *Bot) recordEvent(eventType, username string) {
+	err := b.store.RecordEvent(&Event{
+		Time:     b.clock.Now(),
+		Type:     eventType,
+		Username: username,
+	})
 	if err != nil {
-		return err
-	}
-	w := csv.NewWriter(fo)
-
-	for _, record := range records {
-		if err := w.Write(record); err != nil {
-			log.Fatalln("error writing record to csv:", err)
-		}
-	}
-
-	w.Flush()
-
-	if err := w.Error(); err != nil {
-		return err
+		log.Errorf("record event error: %v", err)
 	}
-
-	return nil
 }
 
-func (b *Bot) getFollowing(username string) ([]*github.User, error) {
-	var collection []*github.User
-	page := 1
-	lastSize := 100
-	for i := 0; lastSize >= 100; i++ {
-		following, resp, err := b.client.Users.ListFollowing(context.Background(), username, &github.ListOptions{
-			Page:    page,
-			PerPage: 100,
-		})
-		if err != nil {
-			return nil, err
-		}
-		if resp.StatusCode != 200 {
-			log.Errorf("received status code %v\n", resp.StatusCode)
-			break
-		}
-		lastSize = len(following)
-		page++
-		log.Printf("fetching %v following\n", lastSize)
-		collection = append(collection, following...)
+func (b *Bot) getFollowing(ctx context.Context, username string) ([]*github.User, error) {
+	pages, errc := b.StreamFollowing(ctx, username, 1)
+	following, err := collectUsers(pages, errc, func(page *UserPage) {
+		log.Printf("fetching %v following\n", len(page.Users))
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	log.Printf("fetched %v following\n", len(collection))
+	log.Printf("fetched %v following\n", len(following))
 
-	return collection, nil
+	return following, nil
 }
 
-func (b *Bot) getFollowers(username string) ([]*github.User, error) {
-	var collection []*github.User
-	page := 1
-	lastSize := 100
-	for i := 0; lastSize >= 100; i++ {
-		followers, resp, err := b.client.Users.ListFollowers(context.Background(), username, &github.ListOptions{
-			Page:    page,
-			PerPage: 100,
-		})
-		if err != nil {
-			return nil, err
-		}
-		if resp.StatusCode != 200 {
-			log.Errorf("received status code %v\n", resp.StatusCode)
-			break
-		}
-		lastSize = len(followers)
-		page++
-		log.Printf("fetching %v followers\n", lastSize)
-		collection = append(collection, followers...)
+func (b *Bot) getFollowers(ctx context.Context, username string) ([]*github.User, error) {
+	pages, errc := b.StreamFollowers(ctx, username, 1)
+	followers, err := collectUsers(pages, errc, func(page *UserPage) {
+		log.Printf("fetching %v followers\n", len(page.Users))
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	log.Printf("fetched %v followers\n", len(collection))
+	log.Printf("fetched %v followers\n", len(followers))
 
-	return collection, nil
+	return followers, nil
 }
 
-func (b *Bot) isActive(username string) (bool, *time.Time, error) {
-	events, resp, err := b.client.Activity.ListEventsPerformedByUser(context.Background(), username, false, &github.ListOptions{
-		Page:    0,
-		PerPage: 2,
+// isActive reports whether the user's two latest events are within the
+// activity window.
+func (b *Bot) isActive(ctx context.Context, username string) (*activity, error) {
+	var events []*github.Event
+	var resp *github.Response
+	err := b.request(ctx, rateCore, func(ctx context.Context) (*github.Response, error) {
+		var err error
+		events, resp, err = b.client.ListEventsPerformedByUser(ctx, username, false, &github.ListOptions{
+			Page:    0,
+			PerPage: activityEvents,
+		})
+		return resp, err
 	})
-	if int(resp.StatusCode/100) != 2 {
-		log.Errorf("received status code %v\n", resp.StatusCode)
-		return false, nil, errors.New(resp.Status)
+	if IsNotFound(err) {
+		// The user was deleted or renamed since it was found.
+		return new(activity), nil
 	}
 	if err != nil {
-		return false, nil, err
+		return nil, err
 	}
-	if len(events) >= 2 {
-		recent := time.Now().Add(-time.Duration(48 * time.Hour))
-		if events[0].CreatedAt.After(recent) && events[1].CreatedAt.After(recent) {
-			return true, events[0].CreatedAt, nil
-		}
+	if int(resp.StatusCode/100) != 2 {
+		log.Errorf("received status code %v\n", resp.StatusCode)
+		return nil, errors.New(resp.Status)
 	}
 
-	return false, nil, nil
+	var times []time.Time
+	for _, event := range events {
+		if event.CreatedAt != nil {
+			times = append(times, *event.CreatedAt)
+		}
+	}
+	return newActivity(times, b.clock.Now()), nil
 }
 
-func (b *Bot) isFollowing(username string) (bool, error) {
-	isFollowing, resp, err := b.client.Users.IsFollowing(context.Background(), b.username, username)
-	if int(resp.StatusCode/100) != 2 {
-		log.Errorf("received status code %v\n", resp.StatusCode)
-		return false, errors.New(resp.Status)
+// newActivity scores the activity at the given times, newest first. A user
+// is active if the two latest are within the activity window.
+func newActivity(times []time.Time, now time.Time) *activity {
+	result := new(activity)
+	for _, t := range times {
+		if now.Sub(t) > activityWindow {
+			continue
+		}
+		result.RecentEvents++
+		result.Score += 1 - float64(now.Sub(t))/float64(activityWindow)
+	}
+	if len(times) > 0 {
+		t := times[0]
+		result.LastActivity = &t
 	}
+	if len(times) >= 2 {
+		recent := now.Add(-activityWindow)
+		result.Active = times[0].After(recent) && times[1].After(recent)
+	}
+	return result
+}
+
+func (b *Bot) isFollowing(ctx context.Context, username string) (bool, error) {
+	var isFollowing bool
+	err := b.request(ctx, rateCore, func(ctx context.Context) (*github.Response, error) {
+		var resp *github.Response
+		var err error
+		isFollowing, resp, err = b.client.IsFollowing(ctx, b.username, username)
+		return resp, err
+	})
 	if err != nil {
 		return false, err
 	}
@@ -494,137 +771,305 @@ func (b *Bot) isFollowing(username string) (bool, error) {
 	return isFollowing, nil
 }
 
-func (b *Bot) follow(username string) error {
-	resp, err := b.client.Users.Follow(context.Background(), username)
-	if int(resp.StatusCode/100) != 2 {
-		log.Errorf("received status code %v\n", resp.StatusCode)
-		return errors.New(resp.Status)
+func (b *Bot) follow(ctx context.Context, username string) error {
+	if b.readOnly {
+		return ErrReadOnly
 	}
+	var resp *github.Response
+	err := b.request(ctx, rateCore, func(ctx context.Context) (*github.Response, error) {
+		var err error
+		resp, err = b.client.Follow(ctx, username)
+		b.audit(AuditFollow, username, resp, err)
+		return resp, err
+	})
 	if err != nil {
 		return err
 	}
+	if int(resp.StatusCode/100) != 2 {
+		log.Errorf("received status code %v\n", resp.StatusCode)
+		return errors.New(resp.Status)
+	}
 
 	return nil
 }
 
 // Unfollow ...
-func (b *Bot) Unfollow(username string) error {
-	resp, err := b.client.Users.Unfollow(context.Background(), username)
-	if int(resp.StatusCode/100) != 2 {
-		log.Errorf("received status code %v\n", resp.StatusCode)
-		return errors.New(resp.Status)
+func (b *Bot) Unfollow(ctx context.Context, username string) error {
+	if b.readOnly {
+		return ErrReadOnly
 	}
+	var resp *github.Response
+	err := b.request(ctx, rateCore, func(ctx context.Context) (*github.Response, error) {
+		var err error
+		resp, err = b.client.Unfollow(ctx, username)
+		b.audit(AuditUnfollow, username, resp, err)
+		return resp, err
+	})
 	if err != nil {
 		return err
 	}
+	if int(resp.StatusCode/100) != 2 {
+		log.Errorf("received status code %v\n", resp.StatusCode)
+		return errors.New(resp.Status)
+	}
 
 	return nil
 }
 
-func (b *Bot) searchUsers(query string, limit int) ([]github.User, error) {
-	var collection []github.User
-	page := 1
-	lastSize := 100
-	maxPage := 5
+// searchUsers returns the users found by the query, at most maxSearchPages
+// pages. If a page fails after the first the users found so far are
+// returned with a PartialResultError.
+func (b *Bot) searchUsers(ctx context.Context, query string) ([]github.User, error) {
 	log.Printf("searching users with %q\n", query)
-	for i := 0; lastSize >= 100 && page < maxPage; i++ {
-		result, resp, err := b.client.Search.Users(context.Background(), query, &github.SearchOptions{
-			ListOptions: github.ListOptions{
-				Page:    page,
-				PerPage: limit,
-			},
+	pages, errc := b.paginate(ctx, rateSearch, 1, maxSearchPages, func(ctx context.Context, opt *github.ListOptions) ([]*github.User, *github.Response, error) {
+		result, resp, err := b.client.SearchUsers(ctx, query, &github.SearchOptions{
+			ListOptions: *opt,
 		})
 		if err != nil {
-			return []github.User{}, err
+			return nil, resp, err
 		}
-		if resp.StatusCode != 200 {
-			log.Errorf("received status code %v\n", resp.StatusCode)
-			break
+		var users []*github.User
+		for i := range result.Users {
+			users = append(users, &result.Users[i])
 		}
-		lastSize = len(result.Users)
-		page++
-		log.Printf("fetching %v users for term %q", lastSize, query)
-		collection = append(collection, result.Users...)
-	}
+		return users, resp, nil
+	})
+	users, err := collectUsers(pages, errc, func(page *UserPage) {
+		log.Printf("fetching %v users for term %q", len(page.Users), query)
+	})
 
-	return collection, nil
+	var collection []github.User
+	for _, user := range users {
+		collection = append(collection, *user)
+	}
+	return collection, err
 }
 
-func (b *Bot) searchActiveUsers(queries []string) error {
+func (b *Bot) searchActiveUsers(ctx context.Context, queries []string) error {
 	log.Println("starting searching for active users")
+	following := make(map[string]bool)
+	if b.snapshot != nil {
+		for _, username := range b.snapshot.Following {
+			following[username] = true
+		}
+	}
 	for _, query := range queries {
 		query := strings.TrimSpace(query)
 		if query == "" {
 			continue
 		}
-		users, err := b.searchUsers(query, 100)
+		users, err := b.searchUsers(withPhase(ctx, PhaseSearch), query)
+		var partial *PartialResultError
+		if errors.As(err, &partial) && ctx.Err() == nil && !isSecondaryLimitError(err) {
+			log.Errorf("search %q incomplete, checking the %v users found: %v", query, partial.Users, err)
+		} else if b.searchUnsupported(err) {
+			log.Errorf("search %q failed, skipping it: %v", query, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		var candidates []github.User
+		for _, user := range users {
+			login := user.GetLogin()
+			if b.originalFollowing[login] {
+				continue
+			}
+			if following[login] && !b.hasTarget(login) {
+				// Followed outside the bot since the baseline.
+				continue
+			}
+			candidates = append(candidates, user)
+		}
+		activityCtx := withPhase(ctx, PhaseActivity)
+		if client, ok := b.client.(ProfileClient); ok && b.graphQL {
+			err = b.checkActiveBatched(activityCtx, client, query, candidates)
+		} else {
+			err = b.checkActive(activityCtx, query, candidates)
+		}
 		if err != nil {
 			return err
 		}
 
-		var wg sync.WaitGroup
+		log.Printf("found %v active targets\n", len(b.targets))
+	}
+
+	log.Println("done searching for active users")
+	return nil
+}
+
+// activityWorkers is the number of users whose activity is checked at once.
+const activityWorkers = 8
+
+// checkActive adds the active users as targets, checking activityWorkers of
+// them concurrently.
+func (b *Bot) checkActive(ctx context.Context, query string, users []github.User) error {
+	queue := make(chan github.User)
+	go func() {
+		defer close(queue)
 		for _, user := range users {
-			wg.Add(1)
-			go func(user github.User) {
-				defer wg.Done()
-				username := user.GetLogin()
-				_, ok := b.originalFollowing[username]
-				if ok {
-					return
-				}
+			select {
+			case queue <- user:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
-				isActive, lastActivity, err := b.isActive(username)
+	var wg sync.WaitGroup
+	var limitErr error
+	for i := 0; i < activityWorkers && i < len(users); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for user := range queue {
+				activity, err := b.isActive(ctx, user.GetLogin())
 				if err != nil {
+					if ctx.Err() != nil {
+						continue
+					}
 					log.Errorf("got error; %s\n", err)
-					return
-				}
-				if isActive {
-					_, found := b.targets[username]
-					if !found {
-						b.targets[username] = &target{
-							username:     username,
-							lastActivity: lastActivity,
-							followed:     false,
-							followedDate: nil,
-							deleted:      false,
-						}
+					if isSecondaryLimitError(err) {
+						b.mu.Lock()
+						limitErr = err
+						b.mu.Unlock()
 					}
+					continue
 				}
-			}(user)
-		}
-		wg.Wait()
+				if activity.Active {
+					b.addTarget(newSearchTarget(user, query, activity, b.clock.Now()))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return limitErr
+}
 
-		log.Printf("found %v active targets\n", len(b.targets))
+// searchUnsupported reports whether a search failed because a GitHub
+// Enterprise Server rejects the query, e.g. qualifiers that older servers do
+// not know, or has search disabled. On GitHub.com such errors are mistakes
+// in the query and are not skipped.
+func (b *Bot) searchUnsupported(err error) bool {
+	var errResp *github.ErrorResponse
+	if !b.enterprise || !errors.As(err, &errResp) || errResp.Response == nil {
+		return false
 	}
+	code := errResp.Response.StatusCode
+	return code == http.StatusNotFound || code == http.StatusUnprocessableEntity
+}
 
-	log.Println("done searching for active users")
-	return nil
+// newSearchTarget returns a target for a user found by a search query.
+func newSearchTarget(user github.User, query string, activity *activity, now time.Time) *Target {
+	return &Target{
+		Username:     user.GetLogin(),
+		UserID:       user.GetID(),
+		Source:       SourceSearch,
+		Query:        query,
+		DiscoveredAt: &now,
+		LastActivity: activity.LastActivity,
+		RecentEvents: activity.RecentEvents,
+		Score:        activity.Score,
+	}
 }
 
-// ThrottleWait ...
-func (b *Bot) ThrottleWait() {
-	i := randomInt(1, 7)
-	time.Sleep(time.Duration(i) * time.Second)
+// hasTarget reports whether the user is a known target.
+func (b *Bot) hasTarget(username string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, found := b.targets[username]
+	return found
 }
 
-func (b *Bot) handleExitSignal() {
-	var gracefulStop = make(chan os.Signal)
-	signal.Notify(gracefulStop, syscall.SIGTERM)
-	signal.Notify(gracefulStop, syscall.SIGINT)
-	go func() {
-		sig := <-gracefulStop
-		log.Printf("caught signal: %+v\n", sig)
-		log.Println("saving latest state")
-		if err := b.saveTargets(); err != nil {
-			panic(err)
+// markFollowedBack records when a followed target was first seen following
+// back.
+func (b *Bot) markFollowedBack(username string, now time.Time) {
+	b.mu.Lock()
+	target, ok := b.targets[username]
+	if !ok || !target.Followed || target.FollowedBackDate != nil {
+		b.mu.Unlock()
+		return
+	}
+	t := now
+	target.FollowedBackDate = &t
+	b.mu.Unlock()
+
+	log.Printf("target %q followed back\n", username)
+	b.saveTarget(target)
+}
+
+// addTarget adds a target unless it is already known.
+func (b *Bot) addTarget(target *Target) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, found := b.targets[target.Username]; !found {
+		b.targets[target.Username] = target
+	}
+}
+
+// updateFollowBacks records when followed targets first show up as
+// followers and returns how many did.
+func (b *Bot) updateFollowBacks() int {
+	if b.snapshot == nil {
+		return 0
+	}
+
+	var count int
+	now := b.clock.Now()
+	for _, username := range b.snapshot.Followers {
+		target, ok := b.targets[username]
+		if !ok || !target.Followed || target.FollowedBackDate != nil {
+			continue
 		}
-		os.Exit(0)
-	}()
+		t := now
+		target.FollowedBackDate = &t
+		log.Printf("target %q followed back\n", username)
+		count++
+	}
+	return count
+}
+
+// ThrottleWait waits a few seconds, or until ctx is done.
+func (b *Bot) ThrottleWait(ctx context.Context) error {
+	i := randomInt(1, 7)
+	return b.clock.Sleep(ctx, time.Duration(i)*time.Second)
 }
 
-func longWait() {
+func usernames(users []*github.User) []string {
+	var names []string
+	for _, user := range users {
+		names = append(names, user.GetLogin())
+	}
+	return names
+}
+
+func sortTargets(targets []*Target) {
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Username < targets[j].Username
+	})
+}
+
+func (b *Bot) longWait(ctx context.Context) error {
 	i := randomInt(500, 1000)
-	time.Sleep(time.Duration(i) * time.Second)
+	return b.clock.Sleep(ctx, time.Duration(i)*time.Second)
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 func randomInt(min, max int) int {
@@ -0,0 +1,206 @@
+package gibot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// profileBatchSize is the number of users fetched per GraphQL query. Larger
+// queries risk GitHub's node limit and timeouts.
+const profileBatchSize = 50
+
+// Profile is a user's profile and follow status.
+type Profile struct {
+	Login string
+	ID    int64
+	// ViewerIsFollowing reports whether the authenticated user follows the
+	// user.
+	ViewerIsFollowing bool
+	// IsFollowingViewer reports whether the user follows the authenticated
+	// user.
+	IsFollowingViewer bool
+}
+
+// ProfileClient is implemented by clients that can fetch the profiles of
+// many users in one request, like the GraphQL API.
+type ProfileClient interface {
+	// Profiles returns the profiles of the logins that exist.
+	Profiles(ctx context.Context, logins []string) (map[string]*Profile, *github.Response, error)
+}
+
+// GraphQLError is an error in a GraphQL response.
+type GraphQLError struct {
+	Type       string        `json:"type"`
+	Path       []interface{} `json:"path"`
+	Message    string        `json:"message"`
+	Extensions struct {
+		Code string `json:"code"`
+	} `json:"extensions"`
+}
+
+func (e *GraphQLError) Error() string {
+	return fmt.Sprintf("graphql: %s", e.Message)
+}
+
+const profileFragment = `
+fragment profile on User {
+  login
+  databaseId
+  viewerIsFollowing
+  isFollowingViewer
+}`
+
+type graphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+type graphQLUser struct {
+	Login             string `json:"login"`
+	DatabaseID        int64  `json:"databaseId"`
+	ViewerIsFollowing bool   `json:"viewerIsFollowing"`
+	IsFollowingViewer bool   `json:"isFollowingViewer"`
+}
+
+// Profiles fetches the profiles with one aliased GraphQL query.
+func (c *githubClient) Profiles(ctx context.Context, logins []string) (map[string]*Profile, *github.Response, error) {
+	var params, fields []string
+	variables := make(map[string]interface{})
+	for i, login := range logins {
+		alias := fmt.Sprintf("u%d", i)
+		params = append(params, fmt.Sprintf("$%s: String!", alias))
+		fields = append(fields, fmt.Sprintf("  %s: user(login: $%s) { ...profile }", alias, alias))
+		variables[alias] = login
+	}
+	query := fmt.Sprintf("query(%s) {\n%s\n}\n%s",
+		strings.Join(params, ", "), strings.Join(fields, "\n"), profileFragment)
+
+	req, err := c.client.NewRequest("POST", c.graphQLURL, &graphQLRequest{
+		Query:     query,
+		Variables: variables,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var result struct {
+		Data   map[string]*graphQLUser `json:"data"`
+		Errors []*GraphQLError         `json:"errors"`
+	}
+	resp, err := c.client.Do(ctx, req, &result)
+	if err != nil {
+		return nil, resp, err
+	}
+	for _, gqlErr := range result.Errors {
+		// Unknown logins come back as null with a NOT_FOUND error.
+		if gqlErr.Type != "NOT_FOUND" {
+			return nil, resp, gqlErr
+		}
+	}
+
+	profiles := make(map[string]*Profile)
+	for _, user := range result.Data {
+		if user == nil {
+			continue
+		}
+		profiles[user.Login] = user.profile()
+	}
+	return profiles, resp, nil
+}
+
+// graphQLUnsupported reports whether err means the server has no GraphQL
+// API, or a schema without the profile fields, like older GitHub Enterprise
+// Servers. Other GraphQL errors, like an invalid query, are not taken to mean
+// that GraphQL is unsupported.
+func graphQLUnsupported(err error) bool {
+	if IsNotFound(err) {
+		return true
+	}
+	var gqlErr *GraphQLError
+	if !errors.As(err, &gqlErr) {
+		return false
+	}
+	return gqlErr.Extensions.Code == "undefinedField" || strings.Contains(gqlErr.Message, "doesn't exist on type")
+}
+
+func (u *graphQLUser) profile() *Profile {
+	return &Profile{
+		Login:             u.Login,
+		ID:                u.DatabaseID,
+		ViewerIsFollowing: u.ViewerIsFollowing,
+		IsFollowingViewer: u.IsFollowingViewer,
+	}
+}
+
+// checkActiveBatched adds the active users as targets like checkActive, but
+// first fetches their profiles in batches through the profile client. The
+// profiles tell which users no longer exist and which are already followed,
+// which are not checked, and which targets followed back. The activity of
+// the other users is checked with the events API, since the contributions
+// GraphQL reports miss activity like stars and comments and only date
+// commits by the day, so targets are the same as without profiles. Users of
+// batches that fail are checked without profiles.
+func (b *Bot) checkActiveBatched(ctx context.Context, client ProfileClient, query string, users []github.User) error {
+	for start := 0; start < len(users); start += profileBatchSize {
+		end := start + profileBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+		batch := users[start:end]
+
+		var logins []string
+		for _, user := range batch {
+			logins = append(logins, user.GetLogin())
+		}
+
+		var profiles map[string]*Profile
+		err := b.request(ctx, rateGraphQL, func(ctx context.Context) (*github.Response, error) {
+			var resp *github.Response
+			var err error
+			profiles, resp, err = client.Profiles(ctx, logins)
+			return resp, err
+		})
+		if err != nil {
+			if isSecondaryLimitError(err) || ctx.Err() != nil {
+				return err
+			}
+			if graphQLUnsupported(err) {
+				log.Warnf("GraphQL profiles not supported, checking users with the REST API: %v", err)
+				b.graphQL = false
+				return b.checkActive(ctx, query, users[start:])
+			}
+			log.Errorf("profiles error, checking %v users without them: %v", len(batch), err)
+			if err := b.checkActive(ctx, query, batch); err != nil {
+				return err
+			}
+			continue
+		}
+
+		now := b.clock.Now()
+		var candidates []github.User
+		for _, user := range batch {
+			profile, ok := profiles[user.GetLogin()]
+			if !ok {
+				// The user was deleted or renamed since it was found.
+				continue
+			}
+			if profile.IsFollowingViewer {
+				b.markFollowedBack(profile.Login, now)
+			}
+			if profile.ViewerIsFollowing && !b.hasTarget(profile.Login) {
+				log.Debugf("skipping %q, already followed", profile.Login)
+				continue
+			}
+			candidates = append(candidates, user)
+		}
+		if err := b.checkActive(ctx, query, candidates); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package gibot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestProfilesQuery(t *testing.T) {
+	var logins []interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req graphQLRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		logins = append(logins, req.Variables["u0"], req.Variables["u1"])
+		fmt.Fprint(w, `{
+			"data": {
+				"u0": {"login": "alice", "databaseId": 1, "viewerIsFollowing": true, "isFollowingViewer": false},
+				"u1": null
+			},
+			"errors": [{"type": "NOT_FOUND", "path": ["u1"], "message": "Could not resolve to a User"}]
+		}`)
+	}))
+	defer server.Close()
+
+	client := &githubClient{client: github.NewClient(nil), graphQLURL: server.URL + "/graphql"}
+	profiles, _, err := client.Profiles(context.Background(), []string{"alice", "ghost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(logins, []interface{}{"alice", "ghost"}) {
+		t.Errorf("queried logins %v", logins)
+	}
+	want := map[string]*Profile{
+		"alice": {Login: "alice", ID: 1, ViewerIsFollowing: true},
+	}
+	if !reflect.DeepEqual(profiles, want) {
+		t.Errorf("profiles = %+v, want %+v", profiles, want)
+	}
+}
+
+func statusError(statusCode int) error {
+	_, err := githubError(statusCode)
+	return err
+}
+
+func TestGraphQLUnsupported(t *testing.T) {
+	undefined := &GraphQLError{Message: "Field 'isFollowingViewer' doesn't exist on type 'User'"}
+	undefined.Extensions.Code = "undefinedField"
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{statusError(http.StatusNotFound), true},
+		{undefined, true},
+		{&GraphQLError{Message: "Field 'viewerIsFollowing' doesn't exist on type 'User'"}, true},
+		{&GraphQLError{Message: "Parse error on \"}\" (RCURLY)"}, false},
+		{&GraphQLError{Type: "RATE_LIMITED", Message: "API rate limit exceeded"}, false},
+		{statusError(http.StatusBadGateway), false},
+		{errTest, false},
+	}
+	for _, test := range tests {
+		if got := graphQLUnsupported(test.err); got != test.want {
+			t.Errorf("graphQLUnsupported(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// searchNow is the time search tests run at.
+var searchNow = time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+
+// newSearchFake returns a fake where alice and erin are active, carol is not
+// and dave is followed by bob outside the bot at searchNow. The only recent
+// events of erin are a star and a comment.
+func newSearchFake() *FakeClient {
+	fake := NewFakeClient("bob")
+	fake.AddEventsOfType("alice", "PullRequestEvent", searchNow.Add(-2*time.Hour))
+	fake.AddEvents("alice", searchNow.Add(-40*time.Hour))
+	fake.AddEvents("carol", searchNow.Add(-10*24*time.Hour))
+	fake.AddEventsOfType("dave", "IssuesEvent", searchNow.Add(-3*time.Hour))
+	fake.AddEventsOfType("erin", "WatchEvent", searchNow.Add(-time.Hour))
+	fake.AddEventsOfType("erin", "IssueCommentEvent", searchNow.Add(-5*time.Hour))
+	fake.SetSearchResults("language:go", "alice", "carol", "dave", "erin")
+	return fake
+}
+
+func searchTargets(t *testing.T, fake *FakeClient, graphQL bool) map[string]*Target {
+	t.Helper()
+	store := NewMemoryStore()
+	store.SaveBaseline(BaselineFollowers, nil)
+	store.SaveBaseline(BaselineFollowing, nil)
+
+	bot := newTestBot(t, fake, store)
+	setTestClock(bot, searchNow)
+	bot.graphQL = graphQL
+	if err := bot.Start(context.Background(), &StartConfig{Search: true, Queries: []string{"language:go"}}); err != nil {
+		t.Fatal(err)
+	}
+	if graphQL && fake.Calls("Profiles") == 0 {
+		t.Fatal("profiles were not fetched with GraphQL")
+	}
+	return bot.targets
+}
+
+func TestCheckActiveBatchedMatchesREST(t *testing.T) {
+	fake := newSearchFake()
+	fake.SetFollowing("bob", "dave")
+	rest := searchTargets(t, fake, false)
+	batched := searchTargets(t, fake, true)
+
+	if len(rest) != 2 || rest["alice"] == nil || rest["erin"] == nil {
+		t.Fatalf("REST targets = %v, want alice and erin", rest)
+	}
+	if !reflect.DeepEqual(batched, rest) {
+		t.Errorf("GraphQL targets differ from REST")
+		for username, want := range rest {
+			t.Logf("%s: GraphQL %+v, REST %+v", username, batched[username], want)
+		}
+	}
+}
+
+func TestCheckActiveBatchedKeepsGraphQLOnQueryError(t *testing.T) {
+	fake := newSearchFake()
+	fake.SetError("Profiles", &GraphQLError{Message: "Parse error on \"}\" (RCURLY)"})
+	bot := newTestBot(t, fake, NewMemoryStore())
+	setTestClock(bot, searchNow)
+	bot.graphQL = true
+
+	users := []github.User{{Login: github.String("alice")}}
+	if err := bot.checkActiveBatched(context.Background(), fake, "language:go", users); err != nil {
+		t.Fatal(err)
+	}
+	if !bot.graphQL {
+		t.Error("GraphQL disabled by a query error")
+	}
+	if bot.targets["alice"] == nil {
+		t.Error("alice not checked without profiles")
+	}
+
+	fake.SetError("Profiles", statusError(http.StatusNotFound))
+	if err := bot.checkActiveBatched(context.Background(), fake, "language:go", users); err != nil {
+		t.Fatal(err)
+	}
+	if bot.graphQL {
+		t.Error("GraphQL not disabled by a 404")
+	}
+}
+
+func TestCheckActiveBatchedFollowBack(t *testing.T) {
+	fake := newSearchFake()
+	fake.SetFollowing("alice", "bob")
+	bot := newTestBot(t, fake, NewMemoryStore())
+	bot.targets["alice"] = &Target{Username: "alice", Followed: true}
+
+	users := []github.User{{Login: github.String("alice")}}
+	if err := bot.checkActiveBatched(context.Background(), fake, "language:go", users); err != nil {
+		t.Fatal(err)
+	}
+	if bot.targets["alice"].FollowedBackDate == nil {
+		t.Error("follow back of alice not recorded")
+	}
+}
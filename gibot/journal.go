@@ -0,0 +1,169 @@
+package gibot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Journal actions.
+const (
+	JournalFollow   = "follow"
+	JournalUnfollow = "unfollow"
+)
+
+// Journal phases. An intent is written before the API call and is followed
+// by either done or failed once the call returns.
+const (
+	JournalIntent = "intent"
+	JournalDone   = "done"
+	JournalFailed = "failed"
+)
+
+// JournalEntry is a write-ahead record of a follow or unfollow.
+type JournalEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Phase    string    `json:"phase"`
+	Username string    `json:"username"`
+}
+
+// journaled runs fn between an intent and an outcome entry in the journal.
+// fn is not run if the intent cannot be written. If fn was canceled or timed
+// out its outcome is unknown, so the intent is left for replayJournal, and
+// clearJournal keeps it until then.
+func (b *Bot) journaled(action, username string, fn func() error) error {
+	if err := b.appendJournal(action, JournalIntent, username); err != nil {
+		return fmt.Errorf("journal intent error: %v", err)
+	}
+
+	if err := fn(); err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		if err := b.appendJournal(action, JournalFailed, username); err != nil {
+			log.Errorf("journal error: %v", err)
+		}
+		return err
+	}
+
+	if err := b.appendJournal(action, JournalDone, username); err != nil {
+		log.Errorf("journal error: %v", err)
+	}
+	return nil
+}
+
+func (b *Bot) appendJournal(action, phase, username string) error {
+	return b.store.AppendJournal(&JournalEntry{
+		Time:     b.clock.Now(),
+		Action:   action,
+		Phase:    phase,
+		Username: username,
+	})
+}
+
+// replayJournal applies the follows and unfollows of an interrupted run to the
+// targets. Intents without an outcome are resolved by asking GitHub whether
+// the user is followed.
+func (b *Bot) replayJournal(ctx context.Context) error {
+	entries, err := b.store.LoadJournal()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		// Drops a torn entry, so the next one is not appended to it.
+		return b.store.ClearJournal()
+	}
+
+	log.Printf("replaying %v journal entries\n", len(entries))
+
+	for _, entry := range lastEntries(entries) {
+		target, ok := b.targets[entry.Username]
+		if !ok {
+			continue
+		}
+
+		done := entry.Phase == JournalDone
+		if entry.Phase == JournalIntent {
+			following, err := b.isFollowing(ctx, entry.Username)
+			if err != nil {
+				return fmt.Errorf("could not resolve journaled %s of %q: %v", entry.Action, entry.Username, err)
+			}
+			done = following == (entry.Action == JournalFollow)
+		}
+		if !done {
+			continue
+		}
+
+		switch entry.Action {
+		case JournalFollow:
+			if !target.Followed {
+				log.Printf("recovered follow of %q from journal\n", entry.Username)
+			}
+			target.Followed = true
+			if target.FollowedDate == nil {
+				t := entry.Time
+				target.FollowedDate = &t
+			}
+		case JournalUnfollow:
+			if !target.Deleted {
+				log.Printf("recovered unfollow of %q from journal\n", entry.Username)
+			}
+			target.Deleted = true
+			if target.UnfollowedDate == nil {
+				t := entry.Time
+				target.UnfollowedDate = &t
+			}
+		}
+	}
+
+	// Every intent is resolved now, so the whole journal can go.
+	if err := b.store.SaveTargets(b.targetList()); err != nil {
+		return err
+	}
+	return b.store.ClearJournal()
+}
+
+// clearJournal empties the journal unless an intent in it has no outcome,
+// e.g. because the run was interrupted during the call. Such an intent is
+// kept for replayJournal to resolve on the next run.
+func (b *Bot) clearJournal() error {
+	entries, err := b.store.LoadJournal()
+	if err != nil {
+		return err
+	}
+	for _, entry := range lastEntries(entries) {
+		if entry.Phase == JournalIntent {
+			log.Printf("keeping journal, %s of %q has no outcome\n", entry.Action, entry.Username)
+			return nil
+		}
+	}
+	return b.store.ClearJournal()
+}
+
+// lastEntries returns the last entry of each action on a user, in the order
+// the actions were first journaled.
+func lastEntries(entries []*JournalEntry) []*JournalEntry {
+	type key struct {
+		action   string
+		username string
+	}
+	var order []key
+	last := make(map[key]*JournalEntry)
+	for _, entry := range entries {
+		k := key{entry.Action, entry.Username}
+		if _, ok := last[k]; !ok {
+			order = append(order, k)
+		}
+		last[k] = entry
+	}
+
+	result := make([]*JournalEntry, len(order))
+	for i, k := range order {
+		result[i] = last[k]
+	}
+	return result
+}
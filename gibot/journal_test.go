@@ -0,0 +1,187 @@
+package gibot
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestReplayJournal(t *testing.T) {
+	fake := NewFakeClient("bob")
+	fake.SetFollowing("bob", "alice", "carol", "erin")
+	fake.AddUser("dave")
+	store := NewMemoryStore()
+	bot := newTestBot(t, fake, store)
+	for _, username := range []string{"alice", "carol", "dave"} {
+		bot.targets[username] = &Target{Username: username}
+	}
+	bot.targets["erin"] = &Target{Username: "erin", Followed: true}
+
+	followed := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, entry := range []*JournalEntry{
+		// Finished before the run was interrupted.
+		{Time: followed, Action: JournalFollow, Phase: JournalIntent, Username: "alice"},
+		{Time: followed, Action: JournalFollow, Phase: JournalDone, Username: "alice"},
+		// Interrupted after the follow went through.
+		{Time: followed, Action: JournalFollow, Phase: JournalIntent, Username: "carol"},
+		// Interrupted before the follow went through.
+		{Time: followed, Action: JournalFollow, Phase: JournalIntent, Username: "dave"},
+		{Time: followed, Action: JournalUnfollow, Phase: JournalIntent, Username: "erin"},
+		{Time: followed, Action: JournalUnfollow, Phase: JournalFailed, Username: "erin"},
+		// Not a target.
+		{Time: followed, Action: JournalFollow, Phase: JournalIntent, Username: "frank"},
+	} {
+		if err := store.AppendJournal(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := bot.replayJournal(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"alice", "carol"} {
+		target := bot.targets[username]
+		if !target.Followed || target.FollowedDate == nil || !target.FollowedDate.Equal(followed) {
+			t.Errorf("%s = %+v, want followed at %v", username, target, followed)
+		}
+	}
+	if bot.targets["dave"].Followed {
+		t.Error("dave not followed on GitHub was marked followed")
+	}
+	if bot.targets["erin"].Deleted {
+		t.Error("failed unfollow of erin was applied")
+	}
+	if calls := fake.Calls("IsFollowing"); calls != 2 {
+		t.Errorf("%v follow checks, want carol and dave", calls)
+	}
+
+	stored, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range stored {
+		if target.Username == "carol" && !target.Followed {
+			t.Error("recovered follow of carol not saved")
+		}
+	}
+}
+
+func TestReplayJournalUnresolved(t *testing.T) {
+	fake := NewFakeClient("bob")
+	fake.AddUser("alice")
+	fake.SetError("IsFollowing", errTest)
+	store := NewMemoryStore()
+	bot := newTestBot(t, fake, store)
+	bot.targets["alice"] = &Target{Username: "alice"}
+	store.AppendJournal(&JournalEntry{Action: JournalFollow, Phase: JournalIntent, Username: "alice"})
+
+	if err := bot.replayJournal(context.Background()); err == nil {
+		t.Fatal("unresolved intent was ignored")
+	}
+	if bot.targets["alice"].Followed {
+		t.Error("unresolved follow of alice was applied")
+	}
+}
+
+func TestReplayJournalTornOnlyEntry(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "journal.csv")
+	torn := strings.Join(journalColumns, ",") + "\n1,follow,inte"
+	if err := os.WriteFile(file, []byte(torn), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := NewCSVStore(dir)
+	bot := newTestBot(t, NewFakeClient("bob"), store)
+
+	if err := bot.replayJournal(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	entry := &JournalEntry{Time: time.Unix(2, 0), Action: JournalFollow, Phase: JournalIntent, Username: "alice"}
+	if err := store.AppendJournal(entry); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := store.LoadJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Username != "alice" {
+		t.Errorf("entries = %+v, want the alice intent only", entries)
+	}
+
+	// Without a replay the entry still starts a row of its own.
+	if err := os.WriteFile(file, []byte(torn), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AppendJournal(entry); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := torn + "\n2,follow,intent,alice\n"; string(data) != want {
+		t.Errorf("journal = %q, want %q", data, want)
+	}
+}
+
+// interruptedFollowClient follows on the fake and then cancels the run, so
+// the bot never learns whether the follow went through.
+type interruptedFollowClient struct {
+	*FakeClient
+	cancel context.CancelFunc
+}
+
+func (c *interruptedFollowClient) Follow(ctx context.Context, user string) (*github.Response, error) {
+	resp, err := c.FakeClient.Follow(ctx, user)
+	if err != nil {
+		return resp, err
+	}
+	c.cancel()
+	return nil, context.Canceled
+}
+
+func TestJournalSurvivesInterruptedFollow(t *testing.T) {
+	fake := NewFakeClient("bob")
+	fake.AddUser("alice")
+	store := NewMemoryStore()
+	if err := store.SaveTargets([]*Target{{Username: "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newTestBot(t, &interruptedFollowClient{FakeClient: fake, cancel: cancel}, store)
+	if err := bot.Start(ctx, &StartConfig{Follow: true}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Start error = %v, want context.Canceled", err)
+	}
+	entries, err := store.LoadJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Phase != JournalIntent || entries[0].Username != "alice" {
+		t.Fatalf("journal = %+v, want the open intent of alice", entries)
+	}
+	bot.Close()
+
+	restarted := newTestBot(t, fake, store)
+	if err := restarted.Start(context.Background(), &StartConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || !targets[0].Followed || targets[0].FollowedDate == nil {
+		t.Errorf("targets = %+v, want the follow of alice recovered", targets)
+	}
+	if entries, _ := store.LoadJournal(); len(entries) != 0 {
+		t.Errorf("journal = %+v, want it cleared once resolved", entries)
+	}
+}
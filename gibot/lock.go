@@ -0,0 +1,138 @@
+package gibot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lockPollInterval is how often a held lock is retried while waiting.
+const lockPollInterval = time.Second
+
+// LockInfo describes the process holding a store lock.
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// LockedError is returned when the store is locked by another process.
+type LockedError struct {
+	Path   string
+	Holder *LockInfo
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("store is locked by another process (%s)", e.Path)
+	}
+	return fmt.Sprintf("store is locked by pid %v on %s since %s (%s)", e.Holder.PID, e.Holder.Host, e.Holder.Started.Format(time.RFC3339), e.Path)
+}
+
+// errLocked is returned by lockFile when another process holds the lock.
+var errLocked = errors.New("locked")
+
+// storeLock is an advisory lock on a store. The lock is taken on the lock
+// file through the operating system, which releases it when the holder
+// exits or crashes, so a lock is never stale. The file records the holder
+// for the error of processes that find it locked.
+type storeLock struct {
+	path string
+	file *os.File
+}
+
+// acquireLock takes the lock at path. If the lock is held it retries for up
+// to wait before returning a *LockedError.
+func acquireLock(path string, wait time.Duration) (*storeLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	logged := false
+	for {
+		err := lockFile(f)
+		if err == nil {
+			break
+		}
+		if err != errLocked {
+			f.Close()
+			return nil, err
+		}
+
+		lockedErr := &LockedError{Path: path, Holder: readLockInfo(path)}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, lockedErr
+		}
+		if !logged {
+			log.Printf("waiting for lock: %v", lockedErr)
+			logged = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	if err := writeLockInfo(f); err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, err
+	}
+	return &storeLock{path: path, file: f}, nil
+}
+
+// writeLockInfo records this process as the holder in the lock file.
+func writeLockInfo(f *os.File) error {
+	host, _ := os.Hostname()
+	data, err := json.Marshal(&LockInfo{
+		PID:     os.Getpid(),
+		Host:    host,
+		Started: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// readLockInfo returns the holder recorded in a lock file, or nil if it is
+// not known yet.
+func readLockInfo(path string) *LockInfo {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	holder := new(LockInfo)
+	if err := json.Unmarshal(data, holder); err != nil {
+		// the holder may still be writing the file
+		return nil
+	}
+	return holder
+}
+
+// release releases the lock. The lock file is kept, since removing it would
+// let a process waiting on the removed file and one creating a new file
+// both take the lock.
+func (l *storeLock) release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	err := unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
@@ -0,0 +1,65 @@
+package gibot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquireLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gibot.lock")
+	lock, err := acquireLock(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = acquireLock(path, 0)
+	var lockedErr *LockedError
+	if !errors.As(err, &lockedErr) {
+		t.Fatalf("second acquire error = %v, want a *LockedError", err)
+	}
+	if lockedErr.Holder == nil || lockedErr.Holder.PID != os.Getpid() {
+		t.Errorf("holder = %+v, want pid %v", lockedErr.Holder, os.Getpid())
+	}
+
+	if err := lock.release(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = acquireLock(path, 0)
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	lock.release()
+}
+
+func TestAcquireLockLeftByCrash(t *testing.T) {
+	// A crashed holder leaves its info behind, but not the lock.
+	path := filepath.Join(t.TempDir(), "gibot.lock")
+	if err := os.WriteFile(path, []byte(`{"pid":1,"host":"elsewhere"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := acquireLock(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.release()
+	if holder := readLockInfo(path); holder == nil || holder.PID != os.Getpid() {
+		t.Errorf("holder = %+v, want this process", holder)
+	}
+}
+
+func TestLockStoreSharedByStores(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := lockStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.release()
+
+	_, err = lockStore(filepath.Join(dir, "gibot.db"), 0)
+	var lockedErr *LockedError
+	if !errors.As(err, &lockedErr) {
+		t.Errorf("database store lock error = %v, want a *LockedError", err)
+	}
+}
@@ -0,0 +1,236 @@
+package gibot
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Phases of a run, used to break down the API cost.
+const (
+	PhasePreflight = "preflight"
+	PhaseSnapshot  = "snapshot"
+	PhaseState     = "state"
+	PhaseSearch    = "search"
+	PhaseActivity  = "activity"
+	PhaseFollow    = "follow"
+	PhaseUnfollow  = "unfollow"
+	PhaseOther     = "other"
+)
+
+type phaseKey struct{}
+
+// withPhase returns a context whose API calls count towards the phase.
+func withPhase(ctx context.Context, phase string) context.Context {
+	return context.WithValue(ctx, phaseKey{}, phase)
+}
+
+func phaseOf(ctx context.Context) string {
+	if phase, ok := ctx.Value(phaseKey{}).(string); ok {
+		return phase
+	}
+	return PhaseOther
+}
+
+// EndpointStats are the metrics of the calls to an endpoint in a phase.
+type EndpointStats struct {
+	Phase string
+	// Endpoint is the method and path, with users replaced by :user.
+	Endpoint string
+	Calls    int
+	Errors   int
+	// Statuses counts the calls by response status code.
+	Statuses map[int]int
+	// RateUsed counts the calls charged to the rate limit. 304 Not Modified
+	// responses are free.
+	RateUsed     int
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+// PhaseCost is the API cost of a phase.
+type PhaseCost struct {
+	Phase        string
+	Calls        int
+	Errors       int
+	RateUsed     int
+	TotalLatency time.Duration
+}
+
+// metricsTransport is an http.RoundTripper that records metrics of every
+// request, and traces them if trace is set.
+type metricsTransport struct {
+	transport http.RoundTripper
+	trace     bool
+	mu        sync.Mutex
+	stats     map[string]*EndpointStats
+}
+
+func newMetricsTransport(transport http.RoundTripper, trace bool) *metricsTransport {
+	return &metricsTransport{
+		transport: transport,
+		trace:     trace,
+		stats:     make(map[string]*EndpointStats),
+	}
+}
+
+// RoundTrip ...
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	phase := phaseOf(req.Context())
+	endpoint := req.Method + " " + endpointPath(req.URL.Path)
+	if t.trace {
+		log.Debugf("--> [%s] %s %s %v", phase, req.Method, req.URL, redactHeader(req.Header))
+	}
+
+	start := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+	latency := time.Since(start)
+
+	if t.trace {
+		if err != nil {
+			log.Debugf("<-- [%s] %s %s error after %v: %v", phase, req.Method, req.URL, latency, err)
+		} else {
+			log.Debugf("<-- [%s] %s %s %s in %v %v", phase, req.Method, req.URL, resp.Status, latency, redactHeader(resp.Header))
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := phase + " " + endpoint
+	stats, ok := t.stats[key]
+	if !ok {
+		stats = &EndpointStats{
+			Phase:    phase,
+			Endpoint: endpoint,
+			Statuses: make(map[int]int),
+		}
+		t.stats[key] = stats
+	}
+	stats.Calls++
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+	if err != nil {
+		stats.Errors++
+		return nil, err
+	}
+	stats.Statuses[resp.StatusCode]++
+	if resp.StatusCode >= 400 {
+		stats.Errors++
+	}
+	if resp.StatusCode != http.StatusNotModified && resp.Header.Get("X-RateLimit-Limit") != "" {
+		stats.RateUsed++
+	}
+	return resp, nil
+}
+
+// endpoints returns a copy of the metrics, sorted by phase and endpoint.
+func (t *metricsTransport) endpoints() []*EndpointStats {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var endpoints []*EndpointStats
+	for _, stats := range t.stats {
+		copied := *stats
+		copied.Statuses = make(map[int]int)
+		for code, n := range stats.Statuses {
+			copied.Statuses[code] = n
+		}
+		endpoints = append(endpoints, &copied)
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Phase != endpoints[j].Phase {
+			return endpoints[i].Phase < endpoints[j].Phase
+		}
+		return endpoints[i].Endpoint < endpoints[j].Endpoint
+	})
+	return endpoints
+}
+
+// Metrics returns the metrics of the API calls made by this bot, by phase
+// and endpoint.
+func (b *Bot) Metrics() []*EndpointStats {
+	return b.metrics.endpoints()
+}
+
+// APICost returns the API cost of this bot by phase.
+func (b *Bot) APICost() []*PhaseCost {
+	costs := make(map[string]*PhaseCost)
+	var phases []string
+	for _, stats := range b.Metrics() {
+		cost, ok := costs[stats.Phase]
+		if !ok {
+			cost = &PhaseCost{Phase: stats.Phase}
+			costs[stats.Phase] = cost
+			phases = append(phases, stats.Phase)
+		}
+		cost.Calls += stats.Calls
+		cost.Errors += stats.Errors
+		cost.RateUsed += stats.RateUsed
+		cost.TotalLatency += stats.TotalLatency
+	}
+
+	var result []*PhaseCost
+	for _, phase := range phases {
+		result = append(result, costs[phase])
+	}
+	return result
+}
+
+// logSummary logs the API cost of the run by phase, and by endpoint at the
+// debug level.
+func (b *Bot) logSummary() {
+	if b.metrics == nil {
+		return
+	}
+
+	log.Println("API cost by phase:")
+	for _, cost := range b.APICost() {
+		log.Printf("  %-10s %5v calls %5v rate limit %5v errors %10v\n", cost.Phase, cost.Calls, cost.RateUsed, cost.Errors, cost.TotalLatency.Round(time.Millisecond))
+	}
+	for _, stats := range b.Metrics() {
+		avg := stats.TotalLatency / time.Duration(stats.Calls)
+		log.Debugf("  %-10s %-40s %5v calls avg %v max %v statuses %v", stats.Phase, stats.Endpoint, stats.Calls, avg.Round(time.Millisecond), stats.MaxLatency.Round(time.Millisecond), stats.Statuses)
+	}
+}
+
+// endpointPath replaces the users in an API path with placeholders, so calls
+// for different users count as one endpoint.
+func endpointPath(path string) string {
+	path = strings.TrimPrefix(path, "/api/v3")
+	segments := strings.Split(path, "/")
+	for i := 1; i < len(segments); i++ {
+		switch segments[i-1] {
+		case "users", "following":
+			if segments[i] != "" {
+				segments[i] = ":user"
+			}
+		case "installations":
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// redactHeader returns the header with credentials replaced.
+func redactHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range []string{"Authorization", "Proxy-Authorization"} {
+		if value := redacted.Get(name); value != "" {
+			scheme := strings.SplitN(value, " ", 2)[0]
+			redacted.Set(name, scheme+" [REDACTED]")
+		}
+	}
+	return redacted
+}
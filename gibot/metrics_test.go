@@ -0,0 +1,144 @@
+package gibot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+func TestTraceRedactsToken(t *testing.T) {
+	var buf bytes.Buffer
+	out, level := log.StandardLogger().Out, log.GetLevel()
+	log.SetOutput(&buf)
+	log.SetLevel(log.DebugLevel)
+	defer func() {
+		log.SetOutput(out)
+		log.SetLevel(level)
+	}()
+
+	client := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "ghp_secret"}),
+			Base:   newMetricsTransport(new(etagServer), true),
+		},
+	}
+	resp, err := client.Get("https://api.github.com/users/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	trace := buf.String()
+	if strings.Contains(trace, "ghp_secret") {
+		t.Errorf("token in the trace:\n%s", trace)
+	}
+	if !strings.Contains(trace, "Bearer [REDACTED]") {
+		t.Errorf("no redacted authorization in the trace:\n%s", trace)
+	}
+}
+
+func TestEndpointPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/users/alice/events":                 "/users/:user/events",
+		"/api/v3/users/alice/followers":       "/users/:user/followers",
+		"/users/alice/following/carol":        "/users/:user/following/:user",
+		"/user/following/alice":               "/user/following/:user",
+		"/search/users":                       "/search/users",
+		"/app/installations/42/access_tokens": "/app/installations/:id/access_tokens",
+		"/rate_limit":                         "/rate_limit",
+		"/users/":                             "/users/",
+	} {
+		if got := endpointPath(path); got != want {
+			t.Errorf("endpointPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+// statusTransport answers requests with the status set for their path, 200
+// by default, charged to the rate limit unless it is 304 Not Modified. Paths
+// set to 0 fail without a response.
+type statusTransport map[string]int
+
+func (t statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	code, ok := t[req.URL.Path]
+	if !ok {
+		code = http.StatusOK
+	}
+	if code == 0 {
+		return nil, errors.New("connection reset")
+	}
+	header := make(http.Header)
+	header.Set("X-RateLimit-Limit", "5000")
+	return &http.Response{StatusCode: code, Status: http.StatusText(code), Header: header, Body: http.NoBody, Request: req}, nil
+}
+
+func TestAPICost(t *testing.T) {
+	bot := newTestBot(t, NewFakeClient("bob"), NewMemoryStore())
+	bot.metrics = newMetricsTransport(statusTransport{
+		"/users/dave/events": http.StatusNotModified,
+		"/users/erin/events": http.StatusNotFound,
+		"/user/following/x":  0,
+	}, false)
+
+	for _, call := range []struct {
+		phase, method, path string
+	}{
+		{PhaseActivity, http.MethodGet, "/users/alice/events"},
+		{PhaseActivity, http.MethodGet, "/users/carol/events"},
+		{PhaseActivity, http.MethodGet, "/users/dave/events"},
+		{PhaseActivity, http.MethodGet, "/users/erin/events"},
+		{PhaseSearch, http.MethodGet, "/search/users"},
+		{PhaseFollow, http.MethodPut, "/user/following/alice"},
+		{PhaseFollow, http.MethodPut, "/user/following/x"},
+		{"", http.MethodGet, "/rate_limit"},
+	} {
+		ctx := context.Background()
+		if call.phase != "" {
+			ctx = withPhase(ctx, call.phase)
+		}
+		req, err := http.NewRequestWithContext(ctx, call.method, "https://api.github.com"+call.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := bot.metrics.RoundTrip(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	var endpoints []EndpointStats
+	for _, stats := range bot.Metrics() {
+		stats.TotalLatency, stats.MaxLatency = 0, 0
+		endpoints = append(endpoints, *stats)
+	}
+	wantEndpoints := []EndpointStats{
+		{Phase: PhaseActivity, Endpoint: "GET /users/:user/events", Calls: 4, Errors: 1, RateUsed: 3, Statuses: map[int]int{200: 2, 304: 1, 404: 1}},
+		{Phase: PhaseFollow, Endpoint: "PUT /user/following/:user", Calls: 2, Errors: 1, RateUsed: 1, Statuses: map[int]int{200: 1}},
+		{Phase: PhaseOther, Endpoint: "GET /rate_limit", Calls: 1, RateUsed: 1, Statuses: map[int]int{200: 1}},
+		{Phase: PhaseSearch, Endpoint: "GET /search/users", Calls: 1, RateUsed: 1, Statuses: map[int]int{200: 1}},
+	}
+	if !reflect.DeepEqual(endpoints, wantEndpoints) {
+		t.Errorf("metrics = %+v, want %+v", endpoints, wantEndpoints)
+	}
+
+	var costs []PhaseCost
+	for _, cost := range bot.APICost() {
+		cost.TotalLatency = 0
+		costs = append(costs, *cost)
+	}
+	wantCosts := []PhaseCost{
+		{Phase: PhaseActivity, Calls: 4, Errors: 1, RateUsed: 3},
+		{Phase: PhaseFollow, Calls: 2, Errors: 1, RateUsed: 1},
+		{Phase: PhaseOther, Calls: 1, RateUsed: 1},
+		{Phase: PhaseSearch, Calls: 1, RateUsed: 1},
+	}
+	if !reflect.DeepEqual(costs, wantCosts) {
+		t.Errorf("costs = %+v, want %+v", costs, wantCosts)
+	}
+}
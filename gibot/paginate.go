@@ -0,0 +1,142 @@
+package gibot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-github/github"
+)
+
+// listPerPage is the page size of user listings, the most GitHub allows.
+const listPerPage = 100
+
+// UserPage is a page of a user listing.
+type UserPage struct {
+	Page int
+	// LastPage is the number of the last page, or 0 if this is the last
+	// page or GitHub did not say.
+	LastPage int
+	Users    []*github.User
+}
+
+// PartialResultError is returned when a listing stops before its last
+// page. The pages before Page were delivered; the listing can be resumed
+// from Page.
+type PartialResultError struct {
+	Page     int
+	LastPage int
+	// Users is the number of users delivered.
+	Users int
+	Err   error
+}
+
+func (e *PartialResultError) Error() string {
+	if e.LastPage > 0 {
+		return fmt.Sprintf("listing stopped at page %v of %v after %v users: %v", e.Page, e.LastPage, e.Users, e.Err)
+	}
+	return fmt.Sprintf("listing stopped at page %v after %v users: %v", e.Page, e.Users, e.Err)
+}
+
+func (e *PartialResultError) Unwrap() error {
+	return e.Err
+}
+
+// pageFunc fetches one page of a user listing.
+type pageFunc func(ctx context.Context, opt *github.ListOptions) ([]*github.User, *github.Response, error)
+
+// paginate streams the pages of a listing, starting at page, following the
+// next page of each response's Link header. It stops after maxPages pages
+// if maxPages is positive. Once the pages channel is closed the error
+// channel yields the error that stopped the listing, if any; the error is a
+// PartialResultError if pages were skipped.
+func (b *Bot) paginate(ctx context.Context, category rateCategory, page, maxPages int, fetch pageFunc) (<-chan *UserPage, <-chan error) {
+	pages := make(chan *UserPage)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(pages)
+
+		if page < 1 {
+			page = 1
+		}
+		first := page
+		fetched, users, lastPage := 0, 0, 0
+		for {
+			var result []*github.User
+			var resp *github.Response
+			err := b.request(ctx, category, func(ctx context.Context) (*github.Response, error) {
+				var err error
+				result, resp, err = fetch(ctx, &github.ListOptions{
+					Page:    page,
+					PerPage: listPerPage,
+				})
+				return resp, err
+			})
+			if err == nil && resp.StatusCode/100 != 2 {
+				err = errors.New(resp.Status)
+			}
+			if err != nil {
+				if page > first {
+					err = &PartialResultError{
+						Page:     page,
+						LastPage: lastPage,
+						Users:    users,
+						Err:      err,
+					}
+				}
+				errc <- err
+				return
+			}
+
+			if resp.LastPage > 0 {
+				lastPage = resp.LastPage
+			}
+			select {
+			case pages <- &UserPage{Page: page, LastPage: resp.LastPage, Users: result}:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+			fetched++
+			users += len(result)
+
+			if resp.NextPage == 0 || (maxPages > 0 && fetched >= maxPages) {
+				return
+			}
+			page = resp.NextPage
+		}
+	}()
+
+	return pages, errc
+}
+
+// StreamFollowers streams the pages of the user's followers, starting at
+// page. See paginate.
+func (b *Bot) StreamFollowers(ctx context.Context, username string, page int) (<-chan *UserPage, <-chan error) {
+	return b.paginate(ctx, rateCore, page, 0, func(ctx context.Context, opt *github.ListOptions) ([]*github.User, *github.Response, error) {
+		return b.client.ListFollowers(ctx, username, opt)
+	})
+}
+
+// StreamFollowing streams the pages of the accounts the user follows,
+// starting at page. See paginate.
+func (b *Bot) StreamFollowing(ctx context.Context, username string, page int) (<-chan *UserPage, <-chan error) {
+	return b.paginate(ctx, rateCore, page, 0, func(ctx context.Context, opt *github.ListOptions) ([]*github.User, *github.Response, error) {
+		return b.client.ListFollowing(ctx, username, opt)
+	})
+}
+
+// collectUsers reads all pages of a listing. On error it returns the users
+// read so far with the error.
+func collectUsers(pages <-chan *UserPage, errc <-chan error, onPage func(*UserPage)) ([]*github.User, error) {
+	var users []*github.User
+	for page := range pages {
+		if onPage != nil {
+			onPage(page)
+		}
+		users = append(users, page.Users...)
+	}
+	return users, <-errc
+}
@@ -0,0 +1,89 @@
+package gibot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestPaginate(t *testing.T) {
+	fake := NewFakeClient("bob")
+	var logins []string
+	for i := 0; i < 2*listPerPage+1; i++ {
+		logins = append(logins, fmt.Sprintf("user%03d", i))
+	}
+	fake.SetFollowing("bob", logins...)
+	bot := newTestBot(t, fake, NewMemoryStore())
+
+	var read []int
+	pages, errc := bot.StreamFollowing(context.Background(), "bob", 1)
+	users, err := collectUsers(pages, errc, func(page *UserPage) {
+		read = append(read, page.Page)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != len(logins) {
+		t.Errorf("%v users, want %v", len(users), len(logins))
+	}
+	if fmt.Sprint(read) != "[1 2 3]" {
+		t.Errorf("pages = %v, want [1 2 3]", read)
+	}
+}
+
+// failingPages returns a pageFunc with three pages of one user that fails
+// from page fail on.
+func failingPages(fail int) pageFunc {
+	return func(ctx context.Context, opt *github.ListOptions) ([]*github.User, *github.Response, error) {
+		if opt.Page >= fail {
+			return nil, fakeResponse(http.StatusBadRequest), errTest
+		}
+		resp := fakeResponse(http.StatusOK)
+		if opt.Page < 3 {
+			resp.NextPage = opt.Page + 1
+		}
+		resp.LastPage = 3
+		return []*github.User{{Login: github.String(fmt.Sprint("user", opt.Page))}}, resp, nil
+	}
+}
+
+func TestPaginatePartialResult(t *testing.T) {
+	bot := newTestBot(t, NewFakeClient("bob"), NewMemoryStore())
+
+	pages, errc := bot.paginate(context.Background(), rateCore, 1, 0, failingPages(3))
+	users, err := collectUsers(pages, errc, nil)
+	var partial *PartialResultError
+	if !errors.As(err, &partial) {
+		t.Fatalf("error = %v, want a PartialResultError", err)
+	}
+	if partial.Page != 3 || partial.LastPage != 3 || partial.Users != 2 || !errors.Is(err, errTest) {
+		t.Errorf("error = %+v, want page 3 of 3 after 2 users", partial)
+	}
+	if len(users) != 2 {
+		t.Errorf("%v users delivered, want 2", len(users))
+	}
+
+	// Resuming at the failed page skips nothing, so it is not partial.
+	pages, errc = bot.paginate(context.Background(), rateCore, 3, 0, failingPages(3))
+	_, err = collectUsers(pages, errc, nil)
+	if !errors.Is(err, errTest) || errors.As(err, &partial) {
+		t.Errorf("error of the first page = %v, want the page error", err)
+	}
+}
+
+func TestPaginateMaxPages(t *testing.T) {
+	bot := newTestBot(t, NewFakeClient("bob"), NewMemoryStore())
+
+	pages, errc := bot.paginate(context.Background(), rateSearch, 1, 2, failingPages(4))
+	users, err := collectUsers(pages, errc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Errorf("%v users, want 2 pages of 1", len(users))
+	}
+}
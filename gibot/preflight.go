@@ -0,0 +1,119 @@
+package gibot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// followScope is the OAuth scope needed to follow and unfollow. The user
+// scope includes it.
+const followScope = "user:follow"
+
+// preflight checks that the token belongs to the configured user and, if
+// follow is set, that it can follow, and reports the rate limits. Start runs
+// it first so a bad token fails the run before any work is done.
+func (b *Bot) preflight(ctx context.Context, follow bool) error {
+	// Installation tokens have no user and no scopes.
+	if !b.app {
+		if err := b.checkIdentity(ctx, follow); err != nil {
+			return err
+		}
+	}
+	return b.reportRateLimits(ctx)
+}
+
+// checkIdentity checks the authenticated user and, unless the bot is
+// read-only, its token scopes.
+func (b *Bot) checkIdentity(ctx context.Context, follow bool) error {
+	var user *github.User
+	var resp *github.Response
+	err := b.request(ctx, rateCore, func(ctx context.Context) (*github.Response, error) {
+		var err error
+		user, resp, err = b.client.AuthenticatedUser(ctx)
+		return resp, err
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return fmt.Errorf("could not get the authenticated user, check that the token is valid and not expired: %v", err)
+	}
+
+	login := user.GetLogin()
+	if !strings.EqualFold(login, b.username) {
+		return fmt.Errorf("the token belongs to %q but the username is %q, use a token of %q or set the username to %q", login, b.username, b.username, login)
+	}
+	if b.readOnly {
+		return nil
+	}
+
+	header, ok := resp.Header["X-Oauth-Scopes"]
+	if !ok {
+		// Fine-grained tokens do not report scopes.
+		log.Warnf("token scopes unknown, make sure the token can follow users")
+		return nil
+	}
+	scopes := parseScopes(strings.Join(header, ","))
+	if scopes[followScope] || scopes["user"] {
+		return nil
+	}
+	if follow {
+		return fmt.Errorf("the token lacks the %s scope, create a token with it to follow and unfollow", followScope)
+	}
+	log.Warnf("the token lacks the %s scope, it cannot follow or unfollow", followScope)
+	return nil
+}
+
+// reportRateLimits logs the rate limits and seeds the rate limiter with
+// them.
+func (b *Bot) reportRateLimits(ctx context.Context) error {
+	var limits *github.RateLimits
+	err := b.request(ctx, rateCore, func(ctx context.Context) (*github.Response, error) {
+		var resp *github.Response
+		var err error
+		limits, resp, err = b.client.RateLimits(ctx)
+		return resp, err
+	})
+	if IsNotFound(err) {
+		// GitHub Enterprise Servers can have rate limiting disabled.
+		log.Println("rate limiting is disabled")
+		return nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return fmt.Errorf("could not get the rate limits: %v", err)
+	}
+
+	for _, limit := range []struct {
+		category rateCategory
+		rate     *github.Rate
+	}{
+		{rateCore, limits.Core},
+		{rateSearch, limits.Search},
+	} {
+		if limit.rate == nil {
+			continue
+		}
+		log.Printf("%s rate limit: %v of %v remaining, resets at %s\n", limit.category, limit.rate.Remaining, limit.rate.Limit, limit.rate.Reset.Local().Format(time.RFC3339))
+		b.limiter.set(limit.category, limit.rate)
+	}
+	return nil
+}
+
+// parseScopes parses an X-OAuth-Scopes header.
+func parseScopes(header string) map[string]bool {
+	scopes := make(map[string]bool)
+	for _, scope := range strings.Split(header, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes[scope] = true
+		}
+	}
+	return scopes
+}
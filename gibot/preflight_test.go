@@ -0,0 +1,182 @@
+package gibot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newServerBot returns a bot of bob that calls the API of a test server
+// running handler, and the server.
+func newServerBot(t *testing.T, handler http.Handler) (*Bot, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	bot, err := NewBot(&Config{
+		AccessToken:  "ghp_test",
+		Username:     "bob",
+		Store:        NewMemoryStore(),
+		BaseURL:      server.URL,
+		DisableCache: true,
+		Retry:        RetryPolicy{MaxRetries: -1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bot.Close() })
+	setTestClock(bot, bot.clock.Now())
+	return bot, server
+}
+
+// identityServer serves the authenticated user with the scopes header, if
+// set, and full rate limits, and records the requests.
+type identityServer struct {
+	mu       sync.Mutex
+	status   int
+	login    string
+	scopes   *string
+	requests []string
+}
+
+func (s *identityServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/api/v3/user":
+		if s.status != 0 {
+			w.WriteHeader(s.status)
+			fmt.Fprint(w, `{"message": "Bad credentials"}`)
+			return
+		}
+		if s.scopes != nil {
+			w.Header().Set("X-OAuth-Scopes", *s.scopes)
+		}
+		fmt.Fprintf(w, `{"login": %q, "id": 1}`, s.login)
+	case "/api/v3/rate_limit":
+		fmt.Fprint(w, `{"resources": {
+			"core": {"limit": 5000, "remaining": 4999, "reset": 1893456000},
+			"search": {"limit": 30, "remaining": 30, "reset": 1893456000}
+		}}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	scopes := func(s string) *string { return &s }
+	for _, test := range []struct {
+		name     string
+		server   *identityServer
+		follow   bool
+		readOnly bool
+		app      bool
+		err      string
+	}{
+		{
+			name:   "follow scope",
+			server: &identityServer{login: "bob", scopes: scopes("repo, user:follow")},
+			follow: true,
+		},
+		{
+			name:   "user scope",
+			server: &identityServer{login: "bob", scopes: scopes("user")},
+			follow: true,
+		},
+		{
+			name:   "login case",
+			server: &identityServer{login: "Bob", scopes: scopes("user:follow")},
+			follow: true,
+		},
+		{
+			name:   "other login",
+			server: &identityServer{login: "alice", scopes: scopes("user:follow")},
+			err:    `the token belongs to "alice" but the username is "bob"`,
+		},
+		{
+			name:   "missing follow scope",
+			server: &identityServer{login: "bob", scopes: scopes("repo, read:user")},
+			follow: true,
+			err:    "the token lacks the user:follow scope",
+		},
+		{
+			name:   "missing follow scope without follows",
+			server: &identityServer{login: "bob", scopes: scopes("")},
+		},
+		{
+			name:   "fine-grained token",
+			server: &identityServer{login: "bob"},
+			follow: true,
+		},
+		{
+			name:     "read-only other login",
+			server:   &identityServer{login: "alice", scopes: scopes("")},
+			readOnly: true,
+			err:      `the token belongs to "alice" but the username is "bob"`,
+		},
+		{
+			name:     "read-only without follow scope",
+			server:   &identityServer{login: "bob", scopes: scopes("")},
+			readOnly: true,
+		},
+		{
+			name:     "app installation",
+			server:   &identityServer{status: http.StatusForbidden},
+			readOnly: true,
+			app:      true,
+		},
+		{
+			name:   "bad credentials",
+			server: &identityServer{status: http.StatusUnauthorized},
+			err:    "could not get the authenticated user, check that the token is valid and not expired",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bot, _ := newServerBot(t, test.server)
+			bot.readOnly = test.readOnly
+			bot.app = test.app
+			err := bot.preflight(context.Background(), test.follow)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("error = %v, want none", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPreflightSeedsRateLimits(t *testing.T) {
+	bot, _ := newServerBot(t, &identityServer{login: "bob"})
+	if err := bot.preflight(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	bot.limiter.mu.Lock()
+	defer bot.limiter.mu.Unlock()
+	if state := bot.limiter.limits[rateCore]; state == nil || state.remaining != 4999 {
+		t.Errorf("core limit = %+v, want 4999 remaining", state)
+	}
+}
+
+func TestStartFailsFastOnPreflight(t *testing.T) {
+	scopes := "read:user"
+	server := &identityServer{login: "bob", scopes: &scopes}
+	bot, _ := newServerBot(t, server)
+
+	err := bot.Start(context.Background(), &StartConfig{Search: true, Queries: []string{"language:go"}, Follow: true})
+	if err == nil || !strings.Contains(err.Error(), "create a token with it to follow and unfollow") {
+		t.Fatalf("error = %v, want the missing scope", err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.requests) != 1 || server.requests[0] != "GET /api/v3/user" {
+		t.Errorf("requests = %v, want only the authenticated user", server.requests)
+	}
+}
@@ -0,0 +1,127 @@
+package gibot
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// rateCategory is a GitHub rate limit category. Each category has its own
+// quota.
+type rateCategory string
+
+const (
+	rateCore   rateCategory = "core"
+	rateSearch rateCategory = "search"
+	// rateGraphQL quota is counted in points per query.
+	rateGraphQL rateCategory = "graphql"
+)
+
+// rateLimitFallback is how long to pause when a rate limit error does not
+// say when the quota resets.
+const rateLimitFallback = time.Minute
+
+// rateLimiter tracks the remaining quota of each category, and blocks
+// callers while a category's quota is exhausted.
+type rateLimiter struct {
+	clock  clock
+	mu     sync.Mutex
+	limits map[rateCategory]*rateState
+}
+
+type rateState struct {
+	remaining int
+	reset     time.Time
+	logged    bool
+}
+
+func newRateLimiter(clock clock) *rateLimiter {
+	return &rateLimiter{
+		clock:  clock,
+		limits: make(map[rateCategory]*rateState),
+	}
+}
+
+// wait blocks until a request in the category can be made, and reserves it,
+// or until ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, category rateCategory) error {
+	for {
+		l.mu.Lock()
+		state, ok := l.limits[category]
+		if !ok || !l.clock.Now().Before(state.reset) {
+			// The quota is unknown or has been reset.
+			delete(l.limits, category)
+			l.mu.Unlock()
+			return nil
+		}
+		if state.remaining > 0 {
+			state.remaining--
+			l.mu.Unlock()
+			return nil
+		}
+		reset := state.reset
+		logged := state.logged
+		state.logged = true
+		l.mu.Unlock()
+
+		if !logged {
+			log.Warnf("%s rate limit exhausted, resuming at %s", category, reset.Local().Format(time.RFC3339))
+		}
+		if err := l.clock.Sleep(ctx, reset.Sub(l.clock.Now())); err != nil {
+			return err
+		}
+	}
+}
+
+// update records the quota reported by a response.
+func (l *rateLimiter) update(category rateCategory, resp *github.Response) {
+	if resp == nil || resp.Rate.Limit == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reset := resp.Rate.Reset.Time
+	state, ok := l.limits[category]
+	if ok && reset.Equal(state.reset) && state.remaining < resp.Rate.Remaining {
+		// Responses of concurrent requests arrive out of order, keep the
+		// lowest count of the window.
+		return
+	}
+	l.limits[category] = &rateState{
+		remaining: resp.Rate.Remaining,
+		reset:     reset,
+	}
+}
+
+// set records the quota reported by the rate limit endpoint.
+func (l *rateLimiter) set(category rateCategory, rate *github.Rate) {
+	if rate == nil || rate.Limit == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limits[category] = &rateState{
+		remaining: rate.Remaining,
+		reset:     rate.Reset.Time,
+	}
+}
+
+// exhausted marks the category's quota as used up until reset.
+func (l *rateLimiter) exhausted(category rateCategory, reset time.Time) {
+	now := l.clock.Now()
+	if !reset.After(now) {
+		reset = now.Add(rateLimitFallback)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limits[category] = &rateState{reset: reset}
+}
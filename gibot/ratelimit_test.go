@@ -0,0 +1,71 @@
+package gibot
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestRequestWaitsForRateLimitReset(t *testing.T) {
+	bot := newTestBot(t, NewFakeClient("bob"), NewMemoryStore())
+	start := bot.clock.Now()
+	reset := start.Add(time.Hour)
+
+	calls := 0
+	err := bot.request(context.Background(), rateCore, func(ctx context.Context) (*github.Response, error) {
+		calls++
+		if calls == 1 {
+			return nil, &github.RateLimitError{
+				Rate:     github.Rate{Limit: 5000, Reset: github.Timestamp{Time: reset}},
+				Response: fakeResponse(http.StatusForbidden).Response,
+			}
+		}
+		return fakeResponse(http.StatusOK), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("%v calls, want the limited call retried once", calls)
+	}
+	if now := bot.clock.Now(); now.Before(reset) {
+		t.Errorf("retried at %v, before the reset at %v", now, reset)
+	}
+}
+
+func TestRequestWaitsForExhaustedQuota(t *testing.T) {
+	bot := newTestBot(t, NewFakeClient("bob"), NewMemoryStore())
+	reset := bot.clock.Now().Add(10 * time.Minute)
+
+	var called []time.Time
+	call := func(ctx context.Context) (*github.Response, error) {
+		called = append(called, bot.clock.Now())
+		resp := fakeResponse(http.StatusOK)
+		resp.Rate = github.Rate{Limit: 30, Remaining: 0, Reset: github.Timestamp{Time: reset}}
+		return resp, nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := bot.request(context.Background(), rateSearch, call); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if called[0].After(reset) || called[1].Before(reset) {
+		t.Errorf("called at %v, want the second call after the reset at %v", called, reset)
+	}
+
+	// Other categories have their own quota.
+	reset = reset.Add(10 * time.Minute)
+	if err := bot.request(context.Background(), rateSearch, call); err != nil {
+		t.Fatal(err)
+	}
+	before := bot.clock.Now()
+	if err := bot.request(context.Background(), rateCore, call); err != nil {
+		t.Fatal(err)
+	}
+	if !bot.clock.Now().Equal(before) {
+		t.Error("core call waited for the search quota")
+	}
+}
@@ -0,0 +1,144 @@
+package gibot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Mismatch kinds found by Reconcile.
+const (
+	// MismatchNotFollowing targets are marked followed but are not followed.
+	MismatchNotFollowing = "marked followed but not followed"
+	// MismatchFollowingUnfollowed targets are marked unfollowed but are
+	// followed.
+	MismatchFollowingUnfollowed = "marked unfollowed but followed"
+	// MismatchFollowingPending targets are not marked followed but are
+	// followed.
+	MismatchFollowingPending = "marked not followed but followed"
+	// MismatchUnknown accounts are followed but are neither targets nor in the
+	// baseline. They are never fixed; add them to the baseline to protect
+	// them.
+	MismatchUnknown = "followed but unknown"
+)
+
+// EventReconciled is recorded for every target fixed by Reconcile.
+const EventReconciled = "reconciled"
+
+// Mismatch is a difference between a stored target and GitHub.
+type Mismatch struct {
+	Username string
+	Kind     string
+	Fixed    bool
+}
+
+// ReconcileReport is the result of Reconcile.
+type ReconcileReport struct {
+	Following  int
+	Mismatches []*Mismatch
+}
+
+// Reconcile compares the followed flags of the targets with the accounts
+// followed on GitHub and, if fix is set, updates the targets to match.
+// Targets that look unfollowed are checked individually before they are
+// reported, since the following list can lag behind.
+func (b *Bot) Reconcile(ctx context.Context, fix bool) (*ReconcileReport, error) {
+	if err := b.loadState(ctx); err != nil {
+		return nil, err
+	}
+
+	users, err := b.getFollowing(ctx, b.username)
+	if err != nil {
+		return nil, err
+	}
+	following := make(map[string]bool)
+	for _, username := range usernames(users) {
+		following[username] = true
+	}
+
+	report := &ReconcileReport{
+		Following: len(following),
+	}
+	now := b.clock.Now()
+	for _, target := range b.targets {
+		var kind string
+		switch {
+		case target.Followed && !target.Deleted && !following[target.Username]:
+			isFollowing, err := b.isFollowing(ctx, target.Username)
+			if err != nil {
+				log.Errorf("could not check %q: %v", target.Username, err)
+				continue
+			}
+			if isFollowing {
+				continue
+			}
+			kind = MismatchNotFollowing
+		case target.Deleted && following[target.Username]:
+			kind = MismatchFollowingUnfollowed
+		case !target.Followed && following[target.Username]:
+			kind = MismatchFollowingPending
+		default:
+			continue
+		}
+
+		mismatch := &Mismatch{
+			Username: target.Username,
+			Kind:     kind,
+		}
+		report.Mismatches = append(report.Mismatches, mismatch)
+		if !fix {
+			continue
+		}
+
+		switch kind {
+		case MismatchNotFollowing:
+			t := now
+			target.Deleted = true
+			target.UnfollowedDate = &t
+		case MismatchFollowingUnfollowed:
+			target.Deleted = false
+			target.UnfollowedDate = nil
+		case MismatchFollowingPending:
+			t := now
+			target.Followed = true
+			target.FollowedDate = &t
+		}
+		mismatch.Fixed = true
+		err := b.store.RecordEvent(&Event{
+			Time:     now,
+			Type:     EventReconciled,
+			Username: target.Username,
+			Message:  kind,
+		})
+		if err != nil {
+			log.Errorf("record event error: %v", err)
+		}
+	}
+
+	for username := range following {
+		if _, ok := b.targets[username]; ok || b.originalFollowing[username] {
+			continue
+		}
+		report.Mismatches = append(report.Mismatches, &Mismatch{
+			Username: username,
+			Kind:     MismatchUnknown,
+		})
+	}
+
+	sort.Slice(report.Mismatches, func(i, j int) bool {
+		if report.Mismatches[i].Kind != report.Mismatches[j].Kind {
+			return report.Mismatches[i].Kind < report.Mismatches[j].Kind
+		}
+		return report.Mismatches[i].Username < report.Mismatches[j].Username
+	})
+
+	if fix {
+		if err := b.saveTargets(); err != nil {
+			return nil, fmt.Errorf("could not save reconciled targets: %v", err)
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,128 @@
+package gibot
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// newReconcileBot returns a bot whose stored targets disagree with GitHub:
+// alice is marked followed but is not followed, carol is followed but not
+// marked followed, gina is followed but marked unfollowed and frank is
+// followed but unknown. hank matches and erin is in the baseline.
+func newReconcileBot(t *testing.T, store *MemoryStore) *Bot {
+	t.Helper()
+	fake := NewFakeClient("bob")
+	fake.AddUser("alice")
+	fake.SetFollowing("bob", "carol", "erin", "frank", "gina", "hank")
+	store.SaveBaseline(BaselineFollowers, nil)
+	store.SaveBaseline(BaselineFollowing, []string{"erin"})
+	err := store.SaveTargets([]*Target{
+		{Username: "alice", Followed: true},
+		{Username: "carol"},
+		{Username: "gina", Followed: true, Deleted: true},
+		{Username: "hank", Followed: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestBot(t, fake, store)
+}
+
+// mismatches returns the mismatches of the report as "username: kind".
+func mismatches(report *ReconcileReport) []string {
+	var result []string
+	for _, mismatch := range report.Mismatches {
+		result = append(result, mismatch.Username+": "+mismatch.Kind)
+	}
+	return result
+}
+
+func TestReconcileReport(t *testing.T) {
+	store := NewMemoryStore()
+	bot := newReconcileBot(t, store)
+
+	report, err := bot.Reconcile(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Following != 5 {
+		t.Errorf("following = %v, want 5", report.Following)
+	}
+	want := []string{
+		"frank: " + MismatchUnknown,
+		"alice: " + MismatchNotFollowing,
+		"carol: " + MismatchFollowingPending,
+		"gina: " + MismatchFollowingUnfollowed,
+	}
+	if got := mismatches(report); !reflect.DeepEqual(got, want) {
+		t.Errorf("mismatches = %q, want %q", got, want)
+	}
+
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range targets {
+		if target.Username == "alice" && target.Deleted || target.Username == "carol" && target.Followed {
+			t.Errorf("report changed stored target %+v", target)
+		}
+	}
+	if events := eventsOf(t, store, EventReconciled); len(events) != 0 {
+		t.Errorf("reconciled events = %v, want none without fix", events)
+	}
+}
+
+func TestReconcileFix(t *testing.T) {
+	store := NewMemoryStore()
+	bot := newReconcileBot(t, store)
+
+	report, err := bot.Reconcile(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mismatch := range report.Mismatches {
+		if fixed := mismatch.Kind != MismatchUnknown; mismatch.Fixed != fixed {
+			t.Errorf("%+v, want fixed %v", mismatch, fixed)
+		}
+	}
+
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := make(map[string]*Target)
+	for _, target := range targets {
+		stored[target.Username] = target
+	}
+	if len(stored) != 4 {
+		t.Errorf("stored targets = %v, want the unknown frank left out", stored)
+	}
+	if alice := stored["alice"]; !alice.Deleted || alice.UnfollowedDate == nil {
+		t.Errorf("alice = %+v, want marked unfollowed", alice)
+	}
+	if carol := stored["carol"]; !carol.Followed || carol.FollowedDate == nil {
+		t.Errorf("carol = %+v, want marked followed", carol)
+	}
+	if gina := stored["gina"]; gina.Deleted || gina.UnfollowedDate != nil {
+		t.Errorf("gina = %+v, want no longer marked unfollowed", gina)
+	}
+	if hank := stored["hank"]; !hank.Followed || hank.Deleted {
+		t.Errorf("hank = %+v, want unchanged", hank)
+	}
+	got := eventsOf(t, store, EventReconciled)
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"alice", "carol", "gina"}) {
+		t.Errorf("reconciled events = %v, want alice, carol and gina", got)
+	}
+
+	// Fixed targets match on the next run.
+	report, err = newTestBot(t, bot.client, store).Reconcile(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mismatches(report), []string{"frank: " + MismatchUnknown}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mismatches after fix = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,191 @@
+package gibot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxRetries is the number of retries of a transient failure when
+	// RetryPolicy.MaxRetries is zero.
+	DefaultMaxRetries = 3
+	// DefaultMinBackoff and DefaultMaxBackoff bound the wait between retries
+	// when RetryPolicy leaves them zero.
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+	// DefaultRequestTimeout limits each API call when Config.RequestTimeout
+	// is zero.
+	DefaultRequestTimeout = 30 * time.Second
+)
+
+// RetryPolicy controls how API calls failing with transient errors are
+// retried. The wait starts at MinBackoff and doubles with every retry up to
+// MaxBackoff, with random jitter. A negative MaxRetries disables retries.
+type RetryPolicy struct {
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// ErrorClass is the kind of failure of an API call.
+type ErrorClass int
+
+const (
+	// ErrorPermanent failures fail again if retried.
+	ErrorPermanent ErrorClass = iota
+	// ErrorTransient failures, like 5xx responses, timeouts and connection
+	// resets, may succeed if retried.
+	ErrorTransient
+	// ErrorNotFound failures are 404 responses, e.g. for deleted users.
+	ErrorNotFound
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorTransient:
+		return "transient"
+	case ErrorNotFound:
+		return "not found"
+	default:
+		return "permanent"
+	}
+}
+
+// ClassifyError returns the class of an error returned by an API call.
+func ClassifyError(err error) ErrorClass {
+	var errResp *github.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		switch code := errResp.Response.StatusCode; {
+		case code == http.StatusNotFound:
+			return ErrorNotFound
+		case code >= 500, code == http.StatusRequestTimeout:
+			return ErrorTransient
+		}
+		return ErrorPermanent
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout(),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.EOF):
+		return ErrorTransient
+	}
+	return ErrorPermanent
+}
+
+// IsNotFound reports whether err is a 404 response.
+func IsNotFound(err error) bool {
+	return err != nil && ClassifyError(err) == ErrorNotFound
+}
+
+// request calls fn, which makes one API call with the context it is given,
+// and handles its failures:
+// rate limit errors wait for the reset and are retried, so no call is
+// dropped; secondary rate limit errors are retried after a pause until the
+// circuit breaker opens; transient errors are retried with backoff under
+// the retry policy. Every API call goes through request. Waits end early
+// when ctx is done.
+func (b *Bot) request(ctx context.Context, category rateCategory, fn func(ctx context.Context) (*github.Response, error)) error {
+	retries := 0
+	for {
+		if err := b.breaker.wait(ctx); err != nil {
+			return err
+		}
+		if err := b.limiter.wait(ctx, category); err != nil {
+			return err
+		}
+		callCtx, cancel := b.callContext(ctx)
+		resp, err := fn(callCtx)
+		cancel()
+		b.limiter.update(category, resp)
+		if err == nil {
+			b.breaker.success()
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var rateErr *github.RateLimitError
+		if errors.As(err, &rateErr) {
+			b.limiter.exhausted(category, rateErr.Rate.Reset.Time)
+			continue
+		}
+		if retryAfter, ok := secondaryLimit(err); ok {
+			if err := b.breaker.hit(err, retryAfter); err != nil {
+				return err
+			}
+			continue
+		}
+		b.breaker.success()
+
+		if ClassifyError(err) != ErrorTransient {
+			return err
+		}
+		maxRetries := b.retryPolicy.MaxRetries
+		if maxRetries == 0 {
+			maxRetries = DefaultMaxRetries
+		}
+		if retries >= maxRetries {
+			if retries == 0 {
+				return err
+			}
+			return fmt.Errorf("giving up after %v retries: %w", retries, err)
+		}
+		retries++
+		delay := b.retryPolicy.backoff(retries)
+		log.Warnf("transient error, retry %v of %v in %v: %v", retries, maxRetries, delay.Round(time.Millisecond), err)
+		if err := b.clock.Sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// callContext returns the context of one API call, limited by the request
+// timeout.
+func (b *Bot) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := b.requestTimeout
+	if timeout == 0 {
+		timeout = DefaultRequestTimeout
+	}
+	if timeout < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// backoff returns the jittered wait before a retry, between half and all
+// of the exponential backoff.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	min := p.MinBackoff
+	if min <= 0 {
+		min = DefaultMinBackoff
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+
+	delay := max
+	if retry < 32 {
+		if d := min << uint(retry-1); d > 0 && d < max {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,181 @@
+package gibot
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestRequestRetriesTransientErrors(t *testing.T) {
+	bot := newTestBot(t, NewFakeClient("bob"), NewMemoryStore())
+	bot.retryPolicy = RetryPolicy{MaxRetries: 2, MinBackoff: time.Second, MaxBackoff: time.Minute}
+
+	calls := 0
+	err := bot.request(context.Background(), rateCore, func(ctx context.Context) (*github.Response, error) {
+		calls++
+		resp := fakeResponse(http.StatusBadGateway)
+		return resp, &github.ErrorResponse{Response: resp.Response, Message: "bad gateway"}
+	})
+	if err == nil || ClassifyError(err) != ErrorTransient {
+		t.Fatalf("error = %v, want the transient error", err)
+	}
+	if calls != 3 {
+		t.Errorf("%v calls, want 1 and 2 retries", calls)
+	}
+}
+
+// githubError returns a go-github error response with the status code.
+func githubError(statusCode int) (*github.Response, error) {
+	resp := fakeResponse(statusCode)
+	return resp, &github.ErrorResponse{Response: resp.Response, Message: http.StatusText(statusCode)}
+}
+
+func TestClassifyError(t *testing.T) {
+	reset := &url.Error{Op: "Get", URL: "https://api.github.com/user", Err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}
+	for _, test := range []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"connection reset", reset, ErrorTransient},
+		{"unexpected EOF", &url.Error{Op: "Get", URL: "https://api.github.com/user", Err: io.ErrUnexpectedEOF}, ErrorTransient},
+		{"timeout", context.DeadlineExceeded, ErrorTransient},
+		{"bad gateway", func() error { _, err := githubError(http.StatusBadGateway); return err }(), ErrorTransient},
+		{"not found", func() error { _, err := githubError(http.StatusNotFound); return err }(), ErrorNotFound},
+		{"forbidden", func() error { _, err := githubError(http.StatusForbidden); return err }(), ErrorPermanent},
+		{"unprocessable", func() error { _, err := githubError(http.StatusUnprocessableEntity); return err }(), ErrorPermanent},
+		{"error response without response", &github.ErrorResponse{Message: "no response"}, ErrorPermanent},
+		{"other", errTest, ErrorPermanent},
+	} {
+		if got := ClassifyError(test.err); got != test.want {
+			t.Errorf("%s: ClassifyError(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestRequestAttempts(t *testing.T) {
+	reset := &url.Error{Op: "Get", URL: "https://api.github.com/user", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	for _, test := range []struct {
+		name       string
+		maxRetries int
+		call       func() (*github.Response, error)
+		calls      int
+		class      ErrorClass
+	}{
+		{
+			name:  "nil response",
+			call:  func() (*github.Response, error) { return nil, io.ErrUnexpectedEOF },
+			calls: DefaultMaxRetries + 1,
+			class: ErrorTransient,
+		},
+		{
+			name:       "connection reset",
+			maxRetries: 1,
+			call:       func() (*github.Response, error) { return nil, reset },
+			calls:      2,
+			class:      ErrorTransient,
+		},
+		{
+			name:       "retries disabled",
+			maxRetries: -1,
+			call:       func() (*github.Response, error) { return nil, reset },
+			calls:      1,
+			class:      ErrorTransient,
+		},
+		{
+			name:  "not found",
+			call:  func() (*github.Response, error) { return githubError(http.StatusNotFound) },
+			calls: 1,
+			class: ErrorNotFound,
+		},
+		{
+			name:  "permanent",
+			call:  func() (*github.Response, error) { return githubError(http.StatusUnprocessableEntity) },
+			calls: 1,
+			class: ErrorPermanent,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bot := newTestBot(t, NewFakeClient("bob"), NewMemoryStore())
+			bot.retryPolicy = RetryPolicy{MaxRetries: test.maxRetries, MinBackoff: time.Second, MaxBackoff: 4 * time.Second}
+			start := bot.clock.Now()
+
+			calls := 0
+			err := bot.request(context.Background(), rateCore, func(ctx context.Context) (*github.Response, error) {
+				calls++
+				return test.call()
+			})
+			if err == nil || ClassifyError(err) != test.class {
+				t.Errorf("error = %v, want a %v error", err, test.class)
+			}
+			if calls != test.calls {
+				t.Errorf("%v calls, want %v", calls, test.calls)
+			}
+			// Each retry waits at most MaxBackoff.
+			if waited := bot.clock.Now().Sub(start); waited > time.Duration(calls-1)*4*time.Second {
+				t.Errorf("waited %v for %v retries", waited, calls-1)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for retry, max := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		5:  10 * time.Second,
+		40: 10 * time.Second,
+	} {
+		for i := 0; i < 20; i++ {
+			if delay := policy.backoff(retry); delay < max/2 || delay > max {
+				t.Errorf("backoff(%v) = %v, want between %v and %v", retry, delay, max/2, max)
+			}
+		}
+	}
+}
+
+// nilResponseClient fails follows and event lists with a transport error and
+// no response, like go-github does when the connection drops.
+type nilResponseClient struct {
+	*FakeClient
+}
+
+func (c *nilResponseClient) Follow(ctx context.Context, user string) (*github.Response, error) {
+	c.FakeClient.Follow(ctx, user)
+	return nil, io.ErrUnexpectedEOF
+}
+
+func (c *nilResponseClient) ListEventsPerformedByUser(ctx context.Context, user string, publicOnly bool, opt *github.ListOptions) ([]*github.Event, *github.Response, error) {
+	c.FakeClient.ListEventsPerformedByUser(ctx, user, publicOnly, opt)
+	return nil, nil, io.ErrUnexpectedEOF
+}
+
+func TestNilResponses(t *testing.T) {
+	fake := NewFakeClient("bob")
+	fake.AddUser("alice")
+	bot := newTestBot(t, &nilResponseClient{fake}, NewMemoryStore())
+	bot.retryPolicy = RetryPolicy{MaxRetries: 1}
+
+	if err := bot.follow(context.Background(), "alice"); err == nil {
+		t.Error("follow without a response did not fail")
+	}
+	if _, err := bot.isActive(context.Background(), "alice"); err == nil {
+		t.Error("activity check without a response did not fail")
+	}
+	if calls := fake.Calls("Follow"); calls != 2 {
+		t.Errorf("%v follow calls, want 1 and 1 retry", calls)
+	}
+	if calls := fake.Calls("ListEventsPerformedByUser"); calls != 2 {
+		t.Errorf("%v event lists, want 1 and 1 retry", calls)
+	}
+}
@@ -0,0 +1,258 @@
+package gibot
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CSVSchemaVersion is the version of the CSV store layout written by this
+// package.
+const CSVSchemaVersion = 2
+
+// csvMigration upgrades a CSV store directory from Version-1 to Version.
+type csvMigration struct {
+	Version     int
+	Description string
+	Migrate     func(dir string) error
+}
+
+// csvMigrations are applied in order to bring older stores up to
+// CSVSchemaVersion. Stores without a schema_version file are version 0.
+var csvMigrations = []csvMigration{
+	{
+		Version:     1,
+		Description: "add deleted column to targets",
+		Migrate:     migrateAddTargetColumns(map[string]string{"deleted": "false"}),
+	},
+	{
+		Version:     2,
+		Description: "add provenance, score and lifecycle columns to targets",
+		Migrate: migrateAddTargetColumns(map[string]string{
+			"user_id":            "0",
+			"source":             "",
+			"query":              "",
+			"discovered_at":      "0",
+			"recent_events":      "0",
+			"score":              "0",
+			"followed_back_date": "0",
+			"unfollowed_date":    "0",
+			"attempts":           "0",
+			"last_error":         "",
+		}),
+	},
+}
+
+// SchemaVersion returns the schema version of the store directory.
+func (s *CSVStore) SchemaVersion() (int, error) {
+	data, err := ioutil.ReadFile(s.schemaFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := parseSchemaVersion(data)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", s.schemaFile, err)
+	}
+	return version, nil
+}
+
+func parseSchemaVersion(data []byte) (int, error) {
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version: %v", err)
+	}
+	return version, nil
+}
+
+// Migrate upgrades the store directory to CSVSchemaVersion. The files of the
+// old version are copied to a backup directory first.
+func (s *CSVStore) Migrate() error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > CSVSchemaVersion {
+		return fmt.Errorf("store schema version %v is newer than the supported version %v", version, CSVSchemaVersion)
+	}
+	if version == CSVSchemaVersion {
+		return nil
+	}
+
+	if _, err := os.Stat(s.targetFile); os.IsNotExist(err) && version == 0 {
+		return s.setSchemaVersion(CSVSchemaVersion)
+	}
+
+	backup := filepath.Join(s.dir, "backups", fmt.Sprintf("schema-v%v-%v", version, time.Now().Unix()))
+	if err := backupCSVFiles(s.dir, backup); err != nil {
+		return err
+	}
+	log.Printf("backed up store schema version %v to %s\n", version, backup)
+
+	for _, migration := range csvMigrations {
+		if migration.Version <= version {
+			continue
+		}
+		log.Printf("migrating store to schema version %v: %s\n", migration.Version, migration.Description)
+		if err := migration.Migrate(s.dir); err != nil {
+			return fmt.Errorf("migration to schema version %v failed: %v", migration.Version, err)
+		}
+		if err := s.setSchemaVersion(migration.Version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *CSVStore) setSchemaVersion(version int) error {
+	return writeFileAtomic(s.schemaFile, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%v\n", version)
+		return err
+	})
+}
+
+// migrateAddTargetColumns returns a migration that appends the missing
+// columns to targets.csv, filled with their default values.
+func migrateAddTargetColumns(defaults map[string]string) func(dir string) error {
+	return func(dir string) error {
+		file := filepath.Join(dir, "targets.csv")
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			return nil
+		}
+
+		lines, err := readCSV(file)
+		if err != nil {
+			return err
+		}
+		if len(lines) == 0 {
+			return nil
+		}
+
+		header := newCSVHeader(lines[0])
+		var columns []string
+		for column := range defaults {
+			if !header.has(column) {
+				columns = append(columns, column)
+			}
+		}
+		if len(columns) == 0 {
+			return nil
+		}
+		sort.Strings(columns)
+
+		width := len(lines[0])
+		lines[0] = append(lines[0], columns...)
+		for i, line := range lines[1:] {
+			for len(line) < width {
+				line = append(line, "")
+			}
+			for _, column := range columns {
+				line = append(line, defaults[column])
+			}
+			lines[i+1] = line
+		}
+
+		return writeCSV(file, lines)
+	}
+}
+
+func backupCSVFiles(dir, backup string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if err != nil {
+		return err
+	}
+	files = append(files, filepath.Join(dir, "schema_version"))
+
+	if err := os.MkdirAll(backup, os.ModePerm); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(backup, filepath.Base(file)), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// csvHeader maps column names to their index so that columns can be looked up
+// by name regardless of their order.
+type csvHeader map[string]int
+
+func newCSVHeader(line []string) csvHeader {
+	header := make(csvHeader)
+	for i, column := range line {
+		header[strings.TrimSpace(column)] = i
+	}
+	return header
+}
+
+func (h csvHeader) has(column string) bool {
+	_, ok := h[column]
+	return ok
+}
+
+// get returns the value of the column in line, or an empty string if the
+// column is unknown or the line is too short.
+func (h csvHeader) get(line []string, column string) string {
+	i, ok := h[column]
+	if !ok || i >= len(line) {
+		return ""
+	}
+	return line[i]
+}
+
+func parseCSVBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+func parseCSVInt(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// formatCSVTime formats a unix timestamp column; nil is zero.
+func formatCSVTime(t *time.Time) string {
+	if t == nil {
+		return "0"
+	}
+	return fmt.Sprintf("%v", t.Unix())
+}
+
+// parseCSVTime parses a unix timestamp column; empty and zero values are nil.
+func parseCSVTime(value string) (*time.Time, error) {
+	if value == "" || value == "0" {
+		return nil, nil
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	t := time.Unix(i, 0)
+	return &t, nil
+}
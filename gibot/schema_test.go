@@ -0,0 +1,80 @@
+package gibot
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCSVStoreMigrate(t *testing.T) {
+	dir := t.TempDir()
+	legacy := "username,last_activity,followed,followed_date\n" +
+		"alice,1577836800,true,1577836900\n" +
+		"bob,0,false\n"
+	if err := os.WriteFile(filepath.Join(dir, "targets.csv"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := NewCSVStore(dir)
+
+	if err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := store.SchemaVersion(); err != nil || version != CSVSchemaVersion {
+		t.Fatalf("schema version = %v, %v, want %v", version, err, CSVSchemaVersion)
+	}
+
+	lines, err := readCSV(store.targetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := newCSVHeader(lines[0])
+	for _, column := range targetColumns {
+		if !header.has(column) {
+			t.Errorf("migrated targets.csv has no %s column", column)
+		}
+	}
+	for _, line := range lines[1:] {
+		if header.get(line, "deleted") != "false" || header.get(line, "attempts") != "0" {
+			t.Errorf("row %v not filled with the defaults", line)
+		}
+	}
+
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Username < targets[j].Username })
+	if len(targets) != 2 {
+		t.Fatalf("targets = %v, want alice and bob", targetNames(targets))
+	}
+	alice := targets[0]
+	if !alice.Followed || alice.Deleted || alice.FollowedDate == nil || !alice.FollowedDate.Equal(time.Unix(1577836900, 0)) {
+		t.Errorf("alice = %+v, want followed at 1577836900", alice)
+	}
+	if bob := targets[1]; bob.Followed || bob.FollowedDate != nil || bob.LastActivity != nil {
+		t.Errorf("bob = %+v, want nothing set", bob)
+	}
+
+	backups, err := filepath.Glob(filepath.Join(dir, "backups", "schema-v0-*"))
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("backups = %v, %v, want one of schema version 0", backups, err)
+	}
+	data, err := os.ReadFile(filepath.Join(backups[0], "targets.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != legacy {
+		t.Errorf("backed up targets.csv = %q, want %q", data, legacy)
+	}
+
+	// Migrating again is a no-op.
+	if err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := filepath.Glob(filepath.Join(dir, "backups", "*")); !reflect.DeepEqual(again, backups) {
+		t.Errorf("backups after a second migration = %v, want %v", again, backups)
+	}
+}
@@ -0,0 +1,165 @@
+package gibot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventPaused is recorded when a run stops because GitHub's secondary rate
+// limit was hit too many times. The message says why.
+const EventPaused = "paused"
+
+const (
+	// secondaryLimitBackoff is the first pause after a secondary rate limit
+	// response without a Retry-After header. It doubles with every hit in a
+	// row.
+	secondaryLimitBackoff    = time.Minute
+	secondaryLimitMaxBackoff = 30 * time.Minute
+	// secondaryLimitMaxHits is how many secondary rate limit hits in a row
+	// open the circuit breaker.
+	secondaryLimitMaxHits = 3
+)
+
+// SecondaryLimitError is returned by every API call once the secondary rate
+// limit was hit too many times in a row. Retrying would make the account's
+// standing worse, so the run should stop.
+type SecondaryLimitError struct {
+	Hits int
+	Err  error
+}
+
+func (e *SecondaryLimitError) Error() string {
+	return fmt.Sprintf("paused after hitting the secondary rate limit %v times in a row: %v", e.Hits, e.Err)
+}
+
+// isSecondaryLimitError reports whether err, or an error it wraps, is a
+// SecondaryLimitError.
+func isSecondaryLimitError(err error) bool {
+	var limitErr *SecondaryLimitError
+	return errors.As(err, &limitErr)
+}
+
+// secondaryLimit reports whether err is a secondary rate limit response, and
+// how long GitHub asked to wait, or 0 if it did not say.
+func secondaryLimit(err error) (time.Duration, bool) {
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) {
+		if abuseErr.RetryAfter != nil {
+			return *abuseErr.RetryAfter, true
+		}
+		return 0, true
+	}
+	var respErr *github.ErrorResponse
+	if errors.As(err, &respErr) {
+		// go-github only detects the older abuse documentation URL.
+		resp := respErr.Response
+		if resp == nil || (resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests) {
+			return 0, false
+		}
+		if !strings.Contains(strings.ToLower(respErr.Message), "secondary rate limit") && resp.Header.Get("Retry-After") == "" {
+			return 0, false
+		}
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if seconds < 0 {
+			seconds = 0
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// circuitBreaker pauses all API calls after a secondary rate limit hit, and
+// opens for good after too many hits in a row.
+type circuitBreaker struct {
+	clock clock
+	mu    sync.Mutex
+	hits  int
+	until time.Time
+	open  *SecondaryLimitError
+}
+
+// wait blocks while calls are paused, and returns an error if the breaker
+// is open or ctx is done.
+func (c *circuitBreaker) wait(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		open := c.open
+		until := c.until
+		c.mu.Unlock()
+
+		if open != nil {
+			return open
+		}
+		now := c.clock.Now()
+		if !now.Before(until) {
+			return nil
+		}
+		if err := c.clock.Sleep(ctx, until.Sub(now)); err != nil {
+			return err
+		}
+	}
+}
+
+// hit records a secondary rate limit response. Hits while calls are already
+// paused count as one, since concurrent calls fail together.
+func (c *circuitBreaker) hit(err error, retryAfter time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.open != nil {
+		return c.open
+	}
+	now := c.clock.Now()
+	if now.Before(c.until) {
+		return nil
+	}
+
+	c.hits++
+	if c.hits >= secondaryLimitMaxHits {
+		c.open = &SecondaryLimitError{Hits: c.hits, Err: err}
+		return c.open
+	}
+
+	delay := retryAfter
+	if delay <= 0 {
+		delay = secondaryLimitBackoff << uint(c.hits-1)
+		if delay > secondaryLimitMaxBackoff {
+			delay = secondaryLimitMaxBackoff
+		}
+	}
+	c.until = now.Add(delay)
+	log.Warnf("secondary rate limit hit (%v of %v), resuming at %s", c.hits, secondaryLimitMaxHits, c.until.Local().Format(time.RFC3339))
+	return nil
+}
+
+// success resets the hits after a call that was not limited.
+func (c *circuitBreaker) success() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.clock.Now().Before(c.until) {
+		c.hits = 0
+	}
+}
+
+// recordPause records why the run paused.
+func (b *Bot) recordPause(err *SecondaryLimitError) {
+	recordErr := b.store.RecordEvent(&Event{
+		Time:     b.clock.Now(),
+		Type:     EventPaused,
+		Username: b.username,
+		Message:  err.Error(),
+	})
+	if recordErr != nil {
+		log.Errorf("record event error: %v", recordErr)
+	}
+}
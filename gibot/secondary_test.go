@@ -0,0 +1,110 @@
+package gibot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestSecondaryLimitWrapped(t *testing.T) {
+	limitErr := &SecondaryLimitError{Hits: secondaryLimitMaxHits, Err: fmt.Errorf("abuse")}
+	if !isSecondaryLimitError(&PartialResultError{Page: 2, Err: limitErr}) {
+		t.Error("secondary limit error inside a partial result not detected")
+	}
+	if isSecondaryLimitError(&PartialResultError{Page: 2, Err: fmt.Errorf("timeout")}) {
+		t.Error("partial result of a timeout detected as a secondary limit error")
+	}
+
+	retryAfter := time.Minute
+	wrapped := fmt.Errorf("follow: %w", &github.AbuseRateLimitError{RetryAfter: &retryAfter})
+	if wait, ok := secondaryLimit(wrapped); !ok || wait != retryAfter {
+		t.Errorf("secondaryLimit = %v, %v, want %v, true", wait, ok, retryAfter)
+	}
+}
+
+// abuseError returns a secondary rate limit error without a Retry-After.
+func abuseError() error {
+	return &github.AbuseRateLimitError{
+		Response: fakeResponse(http.StatusForbidden).Response,
+		Message:  "You have exceeded a secondary rate limit",
+	}
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	bot := newTestBot(t, NewFakeClient("bob"), NewMemoryStore())
+	start := bot.clock.Now()
+
+	calls := 0
+	limited := func(ctx context.Context) (*github.Response, error) {
+		calls++
+		return fakeResponse(http.StatusForbidden), abuseError()
+	}
+	err := bot.request(context.Background(), rateCore, limited)
+	var limitErr *SecondaryLimitError
+	if !errors.As(err, &limitErr) || limitErr.Hits != secondaryLimitMaxHits {
+		t.Fatalf("error = %v, want the breaker open after %v hits", err, secondaryLimitMaxHits)
+	}
+	if calls != secondaryLimitMaxHits {
+		t.Errorf("%v calls, want %v", calls, secondaryLimitMaxHits)
+	}
+	// Paused 1 then 2 minutes between the hits.
+	if paused := bot.clock.Now().Sub(start); paused < 3*secondaryLimitBackoff {
+		t.Errorf("paused %v, want at least %v", paused, 3*secondaryLimitBackoff)
+	}
+
+	err = bot.request(context.Background(), rateCore, func(ctx context.Context) (*github.Response, error) {
+		t.Error("call made with the breaker open")
+		return fakeResponse(http.StatusOK), nil
+	})
+	if !errors.As(err, &limitErr) {
+		t.Errorf("error with the breaker open = %v", err)
+	}
+}
+
+func TestCircuitBreakerResets(t *testing.T) {
+	bot := newTestBot(t, NewFakeClient("bob"), NewMemoryStore())
+
+	// Limited calls that succeed after a pause never open the breaker.
+	for i := 0; i < 2*secondaryLimitMaxHits; i++ {
+		limited := true
+		err := bot.request(context.Background(), rateCore, func(ctx context.Context) (*github.Response, error) {
+			if limited {
+				limited = false
+				return fakeResponse(http.StatusForbidden), abuseError()
+			}
+			return fakeResponse(http.StatusOK), nil
+		})
+		if err != nil {
+			t.Fatalf("call %v: %v", i, err)
+		}
+	}
+}
+
+func TestFollowTargetsHaltsAtSecondaryLimit(t *testing.T) {
+	fake := NewFakeClient("bob")
+	fake.AddUser("alice", "carol")
+	fake.SetError("Follow", abuseError())
+	store := NewMemoryStore()
+	bot := newTestBot(t, fake, store)
+	bot.targets["alice"] = &Target{Username: "alice"}
+	bot.targets["carol"] = &Target{Username: "carol"}
+
+	err := bot.halt(bot.followTargets(context.Background()))
+	if !isSecondaryLimitError(err) {
+		t.Fatalf("error = %v, want a SecondaryLimitError", err)
+	}
+	if calls := fake.Calls("Follow"); calls != secondaryLimitMaxHits {
+		t.Errorf("%v follow calls, want %v for the first target only", calls, secondaryLimitMaxHits)
+	}
+	if got := eventsOf(t, store, EventPaused); len(got) != 1 {
+		t.Errorf("paused events = %v, want 1", got)
+	}
+	if got := fake.Following("bob"); len(got) != 0 {
+		t.Errorf("bob follows %v", got)
+	}
+}
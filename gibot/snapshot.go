@@ -0,0 +1,219 @@
+package gibot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// snapshotIDFormat is the layout of snapshot IDs. The fraction has a fixed
+// width so IDs sort chronologically, and runs in the same second get IDs of
+// their own.
+const snapshotIDFormat = "20060102T150405.000000000Z"
+
+// snapshotTimeFormat parses snapshot IDs, with or without a fraction, which
+// IDs of older versions do not have.
+const snapshotTimeFormat = "20060102T150405Z"
+
+// DefaultSnapshotMaxCount is the number of snapshots kept when
+// SnapshotRetention.MaxCount is zero.
+const DefaultSnapshotMaxCount = 30
+
+// Snapshot is the list of followers and following at a point in time.
+type Snapshot struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Followers []string  `json:"followers"`
+	Following []string  `json:"following"`
+}
+
+// SnapshotRetention controls which snapshots are kept after a new one is
+// taken. A negative MaxCount keeps every snapshot and a zero MaxAge keeps
+// snapshots of any age.
+type SnapshotRetention struct {
+	MaxCount int
+	MaxAge   time.Duration
+}
+
+// SnapshotDiff lists the accounts added and removed between two snapshots.
+type SnapshotDiff struct {
+	From             *Snapshot
+	To               *Snapshot
+	FollowersAdded   []string
+	FollowersRemoved []string
+	FollowingAdded   []string
+	FollowingRemoved []string
+}
+
+// Snapshots returns the stored snapshots, oldest first.
+func (b *Bot) Snapshots() ([]*Snapshot, error) {
+	ids, err := b.store.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*Snapshot
+	for _, id := range ids {
+		snapshot, err := b.store.LoadSnapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// DiffSnapshots compares two snapshots. An empty to is the latest snapshot
+// and an empty from is the one before to.
+func (b *Bot) DiffSnapshots(from, to string) (*SnapshotDiff, error) {
+	ids, err := b.store.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	if to == "" {
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("no snapshots")
+		}
+		to = ids[len(ids)-1]
+	}
+	if from == "" {
+		i := sort.SearchStrings(ids, to)
+		if i == 0 {
+			return nil, fmt.Errorf("no snapshot before %s", to)
+		}
+		from = ids[i-1]
+	}
+
+	fromSnapshot, err := b.store.LoadSnapshot(from)
+	if err != nil {
+		return nil, err
+	}
+	toSnapshot, err := b.store.LoadSnapshot(to)
+	if err != nil {
+		return nil, err
+	}
+
+	followersAdded, followersRemoved := diffUsernames(fromSnapshot.Followers, toSnapshot.Followers)
+	followingAdded, followingRemoved := diffUsernames(fromSnapshot.Following, toSnapshot.Following)
+	return &SnapshotDiff{
+		From:             fromSnapshot,
+		To:               toSnapshot,
+		FollowersAdded:   followersAdded,
+		FollowersRemoved: followersRemoved,
+		FollowingAdded:   followingAdded,
+		FollowingRemoved: followingRemoved,
+	}, nil
+}
+
+// takeSnapshot fetches and stores the current followers and following, then
+// prunes the snapshots that fall out of the retention.
+func (b *Bot) takeSnapshot(ctx context.Context) (*Snapshot, error) {
+	followers, err := b.getFollowers(ctx, b.username)
+	if err != nil {
+		return nil, err
+	}
+	following, err := b.getFollowing(ctx, b.username)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := b.snapshotTime()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{
+		ID:        now.Format(snapshotIDFormat),
+		Time:      now,
+		Followers: usernames(followers),
+		Following: usernames(following),
+	}
+	if err := b.store.SaveSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	log.Printf("saved snapshot %s with %v followers and %v following\n", snapshot.ID, len(snapshot.Followers), len(snapshot.Following))
+
+	if err := b.pruneSnapshots(now); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// snapshotTime returns the time of a new snapshot, moved past the latest
+// stored snapshot if the clock has not, so no snapshot is overwritten.
+func (b *Bot) snapshotTime() (time.Time, error) {
+	now := b.clock.Now().UTC()
+	ids, err := b.store.ListSnapshots()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(ids) == 0 {
+		return now, nil
+	}
+	latest, err := time.Parse(snapshotTimeFormat, ids[len(ids)-1])
+	if err == nil && !now.After(latest) {
+		now = latest.Add(time.Nanosecond)
+	}
+	return now, nil
+}
+
+func (b *Bot) pruneSnapshots(now time.Time) error {
+	ids, err := b.store.ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	maxCount := b.snapshotRetention.MaxCount
+	if maxCount == 0 {
+		maxCount = DefaultSnapshotMaxCount
+	}
+
+	for i, id := range ids {
+		expired := maxCount > 0 && len(ids)-i > maxCount
+		if !expired && b.snapshotRetention.MaxAge > 0 {
+			t, err := time.Parse(snapshotTimeFormat, id)
+			expired = err == nil && now.Sub(t) > b.snapshotRetention.MaxAge
+		}
+		if !expired {
+			continue
+		}
+		if err := b.store.DeleteSnapshot(id); err != nil {
+			return err
+		}
+		log.Printf("deleted snapshot %s\n", id)
+	}
+
+	return nil
+}
+
+// diffUsernames returns the usernames in b that are not in a, and those in a
+// that are not in b, both sorted.
+func diffUsernames(a, b []string) ([]string, []string) {
+	inA := make(map[string]bool)
+	for _, username := range a {
+		inA[username] = true
+	}
+	inB := make(map[string]bool)
+	for _, username := range b {
+		inB[username] = true
+	}
+
+	var added, removed []string
+	for username := range inB {
+		if !inA[username] {
+			added = append(added, username)
+		}
+	}
+	for username := range inA {
+		if !inB[username] {
+			removed = append(removed, username)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
@@ -0,0 +1,156 @@
+package gibot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTakeSnapshotSameTime(t *testing.T) {
+	fake := NewFakeClient("bob")
+	fake.SetFollowing("bob", "carol")
+	store := NewCSVStore(t.TempDir())
+	bot := newTestBot(t, fake, store)
+
+	first, err := bot.takeSnapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The clock of the bot has not moved since.
+	fake.SetFollowing("bob", "dave")
+	second, err := bot.takeSnapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == second.ID {
+		t.Fatalf("both snapshots have ID %s", first.ID)
+	}
+
+	ids, err := store.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{first.ID, second.ID}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("snapshots = %v, want %v", ids, want)
+	}
+	loaded, err := store.LoadSnapshot(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Following, []string{"carol"}) || !loaded.Time.Equal(first.Time) {
+		t.Errorf("first snapshot = %+v, want it kept", loaded)
+	}
+}
+
+func TestLoadSnapshotWithoutFraction(t *testing.T) {
+	store := NewCSVStore(t.TempDir())
+	snapshot := &Snapshot{ID: "20200102T030405Z", Following: []string{"carol"}}
+	if err := store.SaveSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.LoadSnapshot(snapshot.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC); !loaded.Time.Equal(want) {
+		t.Errorf("time = %v, want %v", loaded.Time, want)
+	}
+}
+
+// saveSnapshots stores a snapshot at each time, following the usernames
+// of the same index.
+func saveSnapshots(t *testing.T, store Store, times []time.Time, following ...[]string) []string {
+	t.Helper()
+	var ids []string
+	for i, tm := range times {
+		snapshot := &Snapshot{ID: tm.UTC().Format(snapshotIDFormat), Time: tm.UTC()}
+		if i < len(following) {
+			snapshot.Following = following[i]
+		}
+		if err := store.SaveSnapshot(snapshot); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, snapshot.ID)
+	}
+	return ids
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	now := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+	var times []time.Time
+	for i := 5; i > 0; i-- {
+		times = append(times, now.Add(-time.Duration(i)*24*time.Hour))
+	}
+
+	for _, test := range []struct {
+		name      string
+		retention SnapshotRetention
+		kept      int
+	}{
+		{"default", SnapshotRetention{}, 5},
+		{"max count", SnapshotRetention{MaxCount: 2}, 2},
+		{"max age", SnapshotRetention{MaxCount: -1, MaxAge: 3*24*time.Hour + time.Hour}, 3},
+		{"max count and age", SnapshotRetention{MaxCount: 2, MaxAge: 3*24*time.Hour + time.Hour}, 2},
+		{"keep all", SnapshotRetention{MaxCount: -1}, 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			ids := saveSnapshots(t, store, times)
+			bot := newTestBot(t, NewFakeClient("bob"), store)
+			bot.snapshotRetention = test.retention
+
+			if err := bot.pruneSnapshots(now); err != nil {
+				t.Fatal(err)
+			}
+			kept, err := store.ListSnapshots()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := ids[len(ids)-test.kept:]; !reflect.DeepEqual(kept, want) {
+				t.Errorf("kept %v, want the latest %v", kept, want)
+			}
+		})
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	store := NewMemoryStore()
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ids := saveSnapshots(t, store,
+		[]time.Time{start, start.Add(time.Millisecond), start.Add(time.Hour)},
+		[]string{"alice", "carol"},
+		[]string{"carol", "dave"},
+		[]string{"dave", "erin", "frank"},
+	)
+	bot := newTestBot(t, NewFakeClient("bob"), store)
+
+	for _, test := range []struct {
+		from, to         string
+		wantFrom, wantTo string
+		added, removed   []string
+	}{
+		{"", "", ids[1], ids[2], []string{"erin", "frank"}, []string{"carol"}},
+		{"", ids[1], ids[0], ids[1], []string{"dave"}, []string{"alice"}},
+		{ids[0], ids[2], ids[0], ids[2], []string{"dave", "erin", "frank"}, []string{"alice", "carol"}},
+	} {
+		diff, err := bot.DiffSnapshots(test.from, test.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff.From.ID != test.wantFrom || diff.To.ID != test.wantTo {
+			t.Errorf("DiffSnapshots(%q, %q) compares %s to %s, want %s to %s", test.from, test.to, diff.From.ID, diff.To.ID, test.wantFrom, test.wantTo)
+		}
+		if !reflect.DeepEqual(diff.FollowingAdded, test.added) || !reflect.DeepEqual(diff.FollowingRemoved, test.removed) {
+			t.Errorf("DiffSnapshots(%q, %q) following +%v -%v, want +%v -%v", test.from, test.to, diff.FollowingAdded, diff.FollowingRemoved, test.added, test.removed)
+		}
+	}
+
+	if _, err := bot.DiffSnapshots("", ids[0]); err == nil {
+		t.Error("diff from before the first snapshot did not fail")
+	}
+	empty := newTestBot(t, NewFakeClient("bob"), NewMemoryStore())
+	if _, err := empty.DiffSnapshots("", ""); err == nil {
+		t.Error("diff without snapshots did not fail")
+	}
+}
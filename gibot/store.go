@@ -0,0 +1,279 @@
+package gibot
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store persists the bot state between runs.
+type Store interface {
+	// LoadTargets returns every known target.
+	LoadTargets() ([]*Target, error)
+	// SaveTargets replaces the stored targets.
+	SaveTargets(targets []*Target) error
+	// LoadBaseline returns the usernames of a baseline snapshot and whether
+	// the snapshot has been captured before.
+	LoadBaseline(kind BaselineKind) ([]string, bool, error)
+	// SaveBaseline replaces a baseline snapshot.
+	SaveBaseline(kind BaselineKind, usernames []string) error
+	// RecordEvent records something the bot did.
+	RecordEvent(event *Event) error
+	// LoadEvents returns the recorded events, oldest first.
+	LoadEvents() ([]*Event, error)
+	// AppendJournal durably appends an entry to the journal.
+	AppendJournal(entry *JournalEntry) error
+	// LoadJournal returns the journal entries, oldest first.
+	LoadJournal() ([]*JournalEntry, error)
+	// ClearJournal empties the journal once the targets have been saved.
+	ClearJournal() error
+	// SaveSnapshot stores a snapshot of followers and following.
+	SaveSnapshot(snapshot *Snapshot) error
+	// ListSnapshots returns the IDs of the stored snapshots, oldest first.
+	ListSnapshots() ([]string, error)
+	// LoadSnapshot returns a stored snapshot.
+	LoadSnapshot(id string) (*Snapshot, error)
+	// DeleteSnapshot removes a stored snapshot.
+	DeleteSnapshot(id string) error
+	// AppendAudit appends an entry to the audit log.
+	AppendAudit(entry *AuditEntry) error
+	// LoadAudit returns the audit entries that match the filter, oldest
+	// first.
+	LoadAudit(filter *AuditFilter) ([]*AuditEntry, error)
+}
+
+// TargetUpdater is implemented by stores that can persist a single target
+// without rewriting all of them.
+type TargetUpdater interface {
+	UpdateTarget(target *Target) error
+}
+
+// TargetIndex is implemented by stores that index the targets by state.
+type TargetIndex interface {
+	TargetsByState(state TargetState) ([]*Target, error)
+}
+
+// BaselineKind identifies a baseline snapshot.
+type BaselineKind string
+
+const (
+	// BaselineFollowers are the followers at the time of the first run.
+	BaselineFollowers BaselineKind = "followers"
+	// BaselineFollowing are the accounts followed at the time of the first run;
+	// they are never unfollowed.
+	BaselineFollowing BaselineKind = "following"
+)
+
+// Event types recorded by the bot.
+const (
+	EventFollowed   = "followed"
+	EventUnfollowed = "unfollowed"
+)
+
+// Event ...
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Username string    `json:"username"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// MemoryStore is a Store that keeps everything in memory.
+type MemoryStore struct {
+	mu        sync.Mutex
+	targets   map[string]*Target
+	baselines map[BaselineKind][]string
+	events    []*Event
+	journal   []*JournalEntry
+	snapshots map[string]*Snapshot
+	audit     []*AuditEntry
+}
+
+// NewMemoryStore ...
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		targets:   make(map[string]*Target),
+		baselines: make(map[BaselineKind][]string),
+		snapshots: make(map[string]*Snapshot),
+	}
+}
+
+// LoadTargets ...
+func (s *MemoryStore) LoadTargets() ([]*Target, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var targets []*Target
+	for _, target := range s.targets {
+		t := *target
+		targets = append(targets, &t)
+	}
+	return targets, nil
+}
+
+// SaveTargets ...
+func (s *MemoryStore) SaveTargets(targets []*Target) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.targets = make(map[string]*Target)
+	for _, target := range targets {
+		t := *target
+		s.targets[t.Username] = &t
+	}
+	return nil
+}
+
+// LoadBaseline ...
+func (s *MemoryStore) LoadBaseline(kind BaselineKind) ([]string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usernames, ok := s.baselines[kind]
+	if !ok {
+		return nil, false, nil
+	}
+	return append([]string(nil), usernames...), true, nil
+}
+
+// SaveBaseline ...
+func (s *MemoryStore) SaveBaseline(kind BaselineKind, usernames []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.baselines[kind] = append([]string{}, usernames...)
+	return nil
+}
+
+// RecordEvent ...
+func (s *MemoryStore) RecordEvent(event *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := *event
+	s.events = append(s.events, &e)
+	return nil
+}
+
+// LoadEvents ...
+func (s *MemoryStore) LoadEvents() ([]*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]*Event, len(s.events))
+	for i, event := range s.events {
+		e := *event
+		events[i] = &e
+	}
+	return events, nil
+}
+
+// AppendJournal ...
+func (s *MemoryStore) AppendJournal(entry *JournalEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := *entry
+	s.journal = append(s.journal, &e)
+	return nil
+}
+
+// LoadJournal ...
+func (s *MemoryStore) LoadJournal() ([]*JournalEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]*JournalEntry, len(s.journal))
+	for i, entry := range s.journal {
+		e := *entry
+		entries[i] = &e
+	}
+	return entries, nil
+}
+
+// ClearJournal ...
+func (s *MemoryStore) ClearJournal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.journal = nil
+	return nil
+}
+
+// SaveSnapshot ...
+func (s *MemoryStore) SaveSnapshot(snapshot *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshots[snapshot.ID] = copySnapshot(snapshot)
+	return nil
+}
+
+// ListSnapshots ...
+func (s *MemoryStore) ListSnapshots() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	for id := range s.snapshots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// LoadSnapshot ...
+func (s *MemoryStore) LoadSnapshot(id string) (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot, ok := s.snapshots[id]
+	if !ok {
+		return nil, fmt.Errorf("snapshot %q not found", id)
+	}
+	return copySnapshot(snapshot), nil
+}
+
+// DeleteSnapshot ...
+func (s *MemoryStore) DeleteSnapshot(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.snapshots, id)
+	return nil
+}
+
+func copySnapshot(snapshot *Snapshot) *Snapshot {
+	return &Snapshot{
+		ID:        snapshot.ID,
+		Time:      snapshot.Time,
+		Followers: append([]string(nil), snapshot.Followers...),
+		Following: append([]string(nil), snapshot.Following...),
+	}
+}
+
+// AppendAudit ...
+func (s *MemoryStore) AppendAudit(entry *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := *entry
+	s.audit = append(s.audit, &e)
+	return nil
+}
+
+// LoadAudit ...
+func (s *MemoryStore) LoadAudit(filter *AuditFilter) ([]*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []*AuditEntry
+	for _, entry := range s.audit {
+		if filter.Match(entry) {
+			e := *entry
+			entries = append(entries, &e)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,241 @@
+package gibot
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testStores returns a store of every kind, empty.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	csv := NewCSVStore(t.TempDir())
+	if err := csv.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"csv":    csv,
+		"db":     openTestDB(t, filepath.Join(t.TempDir(), "gibot.db")),
+	}
+}
+
+func TestStoreContract(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			t.Run("targets", func(t *testing.T) { testStoreTargets(t, store) })
+			t.Run("baselines", func(t *testing.T) { testStoreBaselines(t, store) })
+			t.Run("events", func(t *testing.T) { testStoreEvents(t, store) })
+			t.Run("journal", func(t *testing.T) { testStoreJournal(t, store) })
+			t.Run("snapshots", func(t *testing.T) { testStoreSnapshots(t, store) })
+			t.Run("audit", func(t *testing.T) { testStoreAudit(t, store) })
+		})
+	}
+}
+
+// storeTime is a time every store keeps as it is, without a fraction of a
+// second.
+var storeTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// sortedTargetNames returns the usernames of the targets, which stores
+// load in any order, sorted.
+func sortedTargetNames(targets []*Target) []string {
+	names := targetNames(targets)
+	sort.Strings(names)
+	return names
+}
+
+func testStoreTargets(t *testing.T, store Store) {
+	if targets, err := store.LoadTargets(); err != nil || len(targets) != 0 {
+		t.Fatalf("empty store targets = %v, %v", targets, err)
+	}
+
+	followed := storeTime
+	if err := store.SaveTargets([]*Target{
+		{Username: "alice", Followed: true, FollowedDate: &followed, Query: "language:go"},
+		{Username: "carol"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := sortedTargetNames(targets); !reflect.DeepEqual(names, []string{"alice", "carol"}) {
+		t.Fatalf("targets = %v, want alice and carol", names)
+	}
+	for _, target := range targets {
+		if target.Username == "alice" && (!target.Followed || target.FollowedDate == nil || !target.FollowedDate.Equal(followed) || target.Query != "language:go") {
+			t.Errorf("alice = %+v, want followed at %v for language:go", target, followed)
+		}
+	}
+
+	// Saving replaces every target.
+	if err := store.SaveTargets([]*Target{{Username: "dave"}}); err != nil {
+		t.Fatal(err)
+	}
+	targets, err = store.LoadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := sortedTargetNames(targets); !reflect.DeepEqual(names, []string{"dave"}) {
+		t.Errorf("targets after replacing = %v, want dave", names)
+	}
+}
+
+func testStoreBaselines(t *testing.T, store Store) {
+	if _, ok, err := store.LoadBaseline(BaselineFollowers); err != nil || ok {
+		t.Fatalf("baseline before saving = %v, %v, want none", ok, err)
+	}
+
+	if err := store.SaveBaseline(BaselineFollowers, []string{"alice", "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveBaseline(BaselineFollowing, nil); err != nil {
+		t.Fatal(err)
+	}
+	followers, ok, err := store.LoadBaseline(BaselineFollowers)
+	if err != nil || !ok || !reflect.DeepEqual(followers, []string{"alice", "carol"}) {
+		t.Errorf("followers baseline = %v, %v, %v, want alice and carol", followers, ok, err)
+	}
+	following, ok, err := store.LoadBaseline(BaselineFollowing)
+	if err != nil || !ok || len(following) != 0 {
+		t.Errorf("empty following baseline = %v, %v, %v, want captured", following, ok, err)
+	}
+}
+
+func testStoreEvents(t *testing.T, store Store) {
+	want := []*Event{
+		{Time: storeTime, Type: EventFollowed, Username: "alice"},
+		{Time: storeTime.Add(time.Second), Type: EventUnfollowed, Username: "alice"},
+	}
+	for _, event := range want {
+		if err := store.RecordEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := store.LoadEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(want) {
+		t.Fatalf("loaded %v events, want %v", len(events), len(want))
+	}
+	for i, event := range events {
+		if !event.Time.Equal(want[i].Time) || event.Type != want[i].Type || event.Username != want[i].Username {
+			t.Errorf("event %v = %+v, want %+v", i, event, want[i])
+		}
+	}
+}
+
+func testStoreJournal(t *testing.T, store Store) {
+	want := []*JournalEntry{
+		{Time: storeTime, Action: JournalFollow, Phase: JournalIntent, Username: "alice"},
+		{Time: storeTime, Action: JournalFollow, Phase: JournalDone, Username: "alice"},
+		{Time: storeTime, Action: JournalUnfollow, Phase: JournalIntent, Username: "carol"},
+	}
+	for _, entry := range want {
+		if err := store.AppendJournal(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := store.LoadJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("loaded %v journal entries, want %v", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		if entry.Action != want[i].Action || entry.Phase != want[i].Phase || entry.Username != want[i].Username {
+			t.Errorf("journal entry %v = %+v, want %+v", i, entry, want[i])
+		}
+	}
+
+	if err := store.ClearJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := store.LoadJournal(); err != nil || len(entries) != 0 {
+		t.Errorf("journal after clearing = %v, %v, want empty", entries, err)
+	}
+}
+
+func testStoreSnapshots(t *testing.T, store Store) {
+	var ids []string
+	for i, followers := range [][]string{{"alice"}, {"alice", "carol"}} {
+		at := storeTime.Add(time.Duration(i) * time.Hour)
+		snapshot := &Snapshot{
+			ID:        at.Format(snapshotIDFormat),
+			Time:      at,
+			Followers: followers,
+			Following: []string{"dave"},
+		}
+		if err := store.SaveSnapshot(snapshot); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, snapshot.ID)
+	}
+
+	listed, err := store.ListSnapshots()
+	if err != nil || !reflect.DeepEqual(listed, ids) {
+		t.Fatalf("snapshots = %v, %v, want %v", listed, err, ids)
+	}
+	snapshot, err := store.LoadSnapshot(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.ID != ids[1] || !snapshot.Time.Equal(storeTime.Add(time.Hour)) ||
+		!reflect.DeepEqual(snapshot.Followers, []string{"alice", "carol"}) ||
+		!reflect.DeepEqual(snapshot.Following, []string{"dave"}) {
+		t.Errorf("snapshot = %+v", snapshot)
+	}
+
+	if err := store.DeleteSnapshot(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if listed, err := store.ListSnapshots(); err != nil || !reflect.DeepEqual(listed, ids[1:]) {
+		t.Errorf("snapshots after deleting = %v, %v, want %v", listed, err, ids[1:])
+	}
+	if _, err := store.LoadSnapshot(ids[0]); err == nil {
+		t.Error("deleted snapshot loaded")
+	}
+}
+
+func testStoreAudit(t *testing.T, store Store) {
+	reset := storeTime.Add(time.Hour)
+	want := []*AuditEntry{
+		{Time: storeTime, RunID: "run", Action: JournalFollow, Target: "alice", StatusCode: 204, RateLimit: 5000, RateRemaining: 4999, RateReset: &reset},
+		{Time: storeTime.Add(time.Second), RunID: "run", Action: JournalUnfollow, Target: "carol", StatusCode: 502, Error: "bad gateway"},
+	}
+	for _, entry := range want {
+		if err := store.AppendAudit(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := store.LoadAudit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("loaded %v audit entries, want %v", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		w := want[i]
+		if !entry.Time.Equal(w.Time) || entry.RunID != w.RunID || entry.Action != w.Action || entry.Target != w.Target ||
+			entry.StatusCode != w.StatusCode || entry.RateLimit != w.RateLimit || entry.RateRemaining != w.RateRemaining ||
+			(entry.RateReset == nil) != (w.RateReset == nil) || entry.Error != w.Error {
+			t.Errorf("audit entry %v = %+v, want %+v", i, entry, w)
+		}
+		if entry.RateReset != nil && w.RateReset != nil && !entry.RateReset.Equal(*w.RateReset) {
+			t.Errorf("audit entry %v resets at %v, want %v", i, entry.RateReset, w.RateReset)
+		}
+	}
+
+	entries, err = store.LoadAudit(&AuditFilter{Target: "carol"})
+	if err != nil || len(entries) != 1 || entries[0].Target != "carol" {
+		t.Errorf("audit of carol = %v, %v, want one entry", entries, err)
+	}
+}
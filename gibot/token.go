@@ -0,0 +1,210 @@
+package gibot
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenRefresh is how long a token read from a file or a helper command is
+// used before it is read again, so rotated tokens are picked up.
+const tokenRefresh = 5 * time.Minute
+
+// tokenCommandTimeout is how long a credential helper command may run.
+const tokenCommandTimeout = 30 * time.Second
+
+// ErrReadOnly is returned by follows and unfollows of a read-only bot.
+var ErrReadOnly = errors.New("read-only credentials cannot follow or unfollow")
+
+// AppCredentials are the credentials of a GitHub App installation. Its
+// tokens cannot follow users, so a bot using them is read-only.
+type AppCredentials struct {
+	AppID          int64
+	InstallationID int64
+	// PrivateKey is the PEM encoded private key of the app.
+	PrivateKey []byte
+}
+
+// NewFileTokenSource returns a token source that reads the token from a
+// file, and reads it again every few minutes.
+func NewFileTokenSource(path string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, tokenSourceFunc(func() (*oauth2.Token, error) {
+		data, err := os.ReadFile(NormalizePath(path))
+		if err != nil {
+			return nil, err
+		}
+		return newRefreshedToken(string(data), path)
+	}))
+}
+
+// NewCommandTokenSource returns a token source that runs a credential
+// helper command and uses its output as the token. The command runs in the
+// shell, and again every few minutes. It is killed if it runs for longer
+// than tokenCommandTimeout.
+func NewCommandTokenSource(command string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, tokenSourceFunc(func() (*oauth2.Token, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), tokenCommandTimeout)
+		defer cancel()
+
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+		} else {
+			cmd = exec.CommandContext(ctx, "sh", "-c", command)
+		}
+		// Children of the shell can keep its output open after it is killed.
+		cmd.WaitDelay = time.Second
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("token command timed out after %v", tokenCommandTimeout)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("token command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return newRefreshedToken(string(out), "token command")
+	}))
+}
+
+// newRefreshedToken returns a token that expires when it should be read
+// again.
+func newRefreshedToken(token, source string) (*oauth2.Token, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return nil, fmt.Errorf("no token in %s", source)
+	}
+	return &oauth2.Token{
+		AccessToken: token,
+		Expiry:      time.Now().Add(tokenRefresh),
+	}, nil
+}
+
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) {
+	return f()
+}
+
+// newAppTokenSource returns a token source of installation tokens of a
+// GitHub App, refreshed before they expire. baseURL is the REST API URL.
+func newAppTokenSource(app *AppCredentials, baseURL string, transport http.RoundTripper) (oauth2.TokenSource, error) {
+	key, err := parseRSAPrivateKey(app.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	url := fmt.Sprintf("%sapp/installations/%v/access_tokens", baseURL, app.InstallationID)
+	client := &http.Client{Transport: transport}
+
+	return oauth2.ReuseTokenSource(nil, tokenSourceFunc(func() (*oauth2.Token, error) {
+		jwt, err := appJWT(app.AppID, key, time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusCreated {
+			return nil, fmt.Errorf("installation token request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+
+		var result struct {
+			Token     string    `json:"token"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, err
+		}
+		return &oauth2.Token{
+			AccessToken: result.Token,
+			Expiry:      result.ExpiresAt,
+		}, nil
+	})), nil
+}
+
+// appJWT returns the RS256 signed JSON web token that authenticates as a
+// GitHub App. GitHub accepts at most ten minutes of validity; the issue
+// time is backdated for clock drift.
+func appJWT(appID int64, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(signature), nil
+}
+
+// parseRSAPrivateKey parses a PEM encoded PKCS #1 or PKCS #8 RSA key.
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in app private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid app private key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("app private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
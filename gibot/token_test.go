@@ -0,0 +1,171 @@
+package gibot
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAppKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestAppJWT(t *testing.T) {
+	key, _ := testAppKey(t)
+	now := time.Unix(1577836800, 0)
+	jwt, err := appJWT(42, key, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("jwt %q has %v parts, want 3", jwt, len(parts))
+	}
+	enc := base64.RawURLEncoding
+	signature, err := enc.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature); err != nil {
+		t.Errorf("invalid signature: %v", err)
+	}
+
+	var header map[string]string
+	data, _ := enc.DecodeString(parts[0])
+	if err := json.Unmarshal(data, &header); err != nil || header["alg"] != "RS256" {
+		t.Errorf("header = %s, want RS256", data)
+	}
+	var claims struct {
+		IssuedAt  int64 `json:"iat"`
+		ExpiresAt int64 `json:"exp"`
+		Issuer    int64 `json:"iss"`
+	}
+	data, _ = enc.DecodeString(parts[1])
+	if err := json.Unmarshal(data, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != 42 || claims.IssuedAt != now.Add(-time.Minute).Unix() || claims.ExpiresAt != now.Add(9*time.Minute).Unix() {
+		t.Errorf("claims = %+v, want app 42 valid from a minute ago for ten minutes", claims)
+	}
+}
+
+func TestParseRSAPrivateKey(t *testing.T) {
+	key, pkcs8 := testAppKey(t)
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	for _, data := range [][]byte{pkcs1, pkcs8} {
+		parsed, err := parseRSAPrivateKey(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Equal(key) {
+			t.Error("parsed key differs")
+		}
+	}
+	if _, err := parseRSAPrivateKey([]byte("not a key")); err == nil {
+		t.Error("no error parsing a file without PEM data")
+	}
+}
+
+// tokenServer answers installation token requests.
+type tokenServer struct {
+	t   *testing.T
+	url string
+}
+
+func (s *tokenServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || req.URL.String() != s.url {
+		s.t.Errorf("request = %s %s, want POST %s", req.Method, req.URL, s.url)
+	}
+	if auth := req.Header.Get("Authorization"); !strings.HasPrefix(auth, "Bearer ") || strings.Count(auth, ".") != 2 {
+		s.t.Errorf("authorization = %q, want a JWT", auth)
+	}
+	body := `{"token":"ghs_installation","expires_at":"2030-01-01T00:00:00Z"}`
+	return &http.Response{
+		StatusCode: http.StatusCreated,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestAppTokenSource(t *testing.T) {
+	_, key := testAppKey(t)
+	app := &AppCredentials{AppID: 42, InstallationID: 7, PrivateKey: key}
+	server := &tokenServer{t: t, url: "https://github.example.com/api/v3/app/installations/7/access_tokens"}
+	ts, err := newAppTokenSource(app, "https://github.example.com/api/v3", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "ghs_installation" || !token.Expiry.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("token = %+v, want the installation token", token)
+	}
+}
+
+func TestFileTokenSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("ghp_file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewFileTokenSource(path).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "ghp_file" || !token.Expiry.After(time.Now()) {
+		t.Errorf("token = %+v, want ghp_file read again later", token)
+	}
+
+	if err := os.WriteFile(path, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileTokenSource(path).Token(); err == nil {
+		t.Error("no error reading an empty token file")
+	}
+}
+
+func TestCommandTokenSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands run in sh")
+	}
+
+	token, err := NewCommandTokenSource("echo ghp_command").Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "ghp_command" {
+		t.Errorf("token = %q, want ghp_command", token.AccessToken)
+	}
+
+	_, err = NewCommandTokenSource("echo locked >&2; exit 1").Token()
+	if err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("error = %v, want the stderr of the command", err)
+	}
+}